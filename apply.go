@@ -0,0 +1,318 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/compression"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// Apply reconstructs the complete final image from the incremental archive pointed
+// by src and the base image pointed by base, writing it to dst. No registry is
+// involved: base and dst must use local transports (e.g. oci:/path:tag,
+// docker-archive:/path or containers-storage:image). Layers omitted from the archive
+// are read from the base, if the base stores them with a different compression
+// (as docker-archive does) the base layer is used in place of the omitted one, as
+// its uncompressed content is the same the image configuration remains valid but the
+// manifest digest changes. If the archive holds a manifest list the image matching
+// the base platform is written. The archive is decrypted and verified as on Push.
+func (inc *Incremental) Apply(ctx context.Context, base, src, dst string) error {
+	baseref, err := localReference(base)
+	if err != nil {
+		return fmt.Errorf("error parsing base reference: %w", err)
+	}
+	dstref, err := localReference(dst)
+	if err != nil {
+		return fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	src, cleanup, err := inc.decryptArchive(src)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := inc.verifyArchive(src); err != nil {
+		return fmt.Errorf("error verifying archive: %w", err)
+	}
+	diffref, err := alltransports.ParseImageName(fmt.Sprintf("oci-archive:%s", src))
+	if err != nil {
+		return fmt.Errorf("error parsing archive reference: %w", err)
+	}
+	polctx, err := policyContext()
+	if err != nil {
+		return fmt.Errorf("error creating policy context: %w", err)
+	}
+	// layers are written as they are, compressing them would change the digests.
+	sysctx := &types.SystemContext{
+		BigFilesTemporaryDir:        inc.tmpdir,
+		OCIAcceptUncompressedLayers: true,
+	}
+	if _, err := copy.Image(
+		ctx,
+		polctx,
+		dstref,
+		&applyReference{ImageReference: diffref, base: baseref},
+		&copy.Options{
+			ReportWriter:         inc.report,
+			SourceCtx:            sysctx,
+			DestinationCtx:       sysctx,
+			MaxParallelDownloads: inc.parallel,
+		},
+	); err != nil {
+		return fmt.Errorf("error applying archive: %w", err)
+	}
+	return nil
+}
+
+// localReference parses the provided reference, refusing references that point
+// to a registry.
+func localReference(ref string) (types.ImageReference, error) {
+	parsed, err := alltransports.ParseImageName(ref)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Transport().Name() == "docker" {
+		return nil, fmt.Errorf("%s is not a local reference", ref)
+	}
+	return parsed, nil
+}
+
+// applyReference wraps the reference to an incremental archive. Its image source
+// completes the archive with the layers of a local base image.
+type applyReference struct {
+	types.ImageReference
+	base types.ImageReference
+}
+
+// NewImageSource opens both the archive and the base image and returns a source
+// for the complete image.
+func (a *applyReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	diff, err := a.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	base, err := a.base.NewImageSource(ctx, sys)
+	if err != nil {
+		diff.Close()
+		return nil, fmt.Errorf("error opening base image: %w", err)
+	}
+	src := &applySource{ImageSource: diff, base: base}
+	if err := src.prepare(ctx); err != nil {
+		src.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// applySource is an image source reading blobs from an incremental archive and,
+// for the layers omitted from the archive, from a local base image. The manifest
+// is the archive manifest with the omitted layers the base stores differently
+// replaced by the base ones.
+type applySource struct {
+	types.ImageSource
+	base     types.ImageSource
+	manifest []byte
+	mime     string
+}
+
+// prepare reads the base and the archive manifests and builds the manifest of the
+// complete image.
+func (a *applySource) prepare(ctx context.Context) error {
+	layers, platform, err := baseLayers(ctx, a.base)
+	if err != nil {
+		return fmt.Errorf("error reading base image: %w", err)
+	}
+	raw, mime, err := a.ImageSource.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error reading archive manifest: %w", err)
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return fmt.Errorf("error parsing archive manifest list: %w", err)
+		}
+		instance, err := list.ChooseInstance(platform)
+		if err != nil {
+			return fmt.Errorf("error choosing image matching the base platform: %w", err)
+		}
+		if raw, mime, err = a.ImageSource.GetManifest(ctx, &instance); err != nil {
+			return fmt.Errorf("error reading archive manifest %s: %w", instance, err)
+		}
+	}
+	config, err := a.config(ctx, raw, mime)
+	if err != nil {
+		return err
+	}
+	var man imgspecv1.Manifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return fmt.Errorf("error parsing archive manifest: %w", err)
+	}
+	changed := false
+	for i, layer := range man.Layers {
+		if a.hasBlob(ctx, a.ImageSource, layer.Digest) || a.hasBlob(ctx, a.base, layer.Digest) {
+			continue
+		}
+		if i >= len(config.RootFS.DiffIDs) {
+			return fmt.Errorf("layer %s has no diff id in the image config", layer.Digest)
+		}
+		info, ok := layers[config.RootFS.DiffIDs[i]]
+		if !ok {
+			return fmt.Errorf("layer %s found neither in the archive nor in the base image", layer.Digest)
+		}
+		if mime != imgspecv1.MediaTypeImageManifest {
+			return fmt.Errorf("layer %s can't be replaced in a %s manifest", layer.Digest, mime)
+		}
+		mediaType, err := a.layerMediaType(ctx, info)
+		if err != nil {
+			return err
+		}
+		man.Layers[i] = imgspecv1.Descriptor{
+			MediaType: mediaType,
+			Digest:    info.Digest,
+			Size:      info.Size,
+		}
+		changed = true
+	}
+	if changed {
+		if raw, err = json.Marshal(man); err != nil {
+			return fmt.Errorf("error encoding manifest: %w", err)
+		}
+	}
+	a.manifest, a.mime = raw, mime
+	return nil
+}
+
+// config reads the image configuration referred by the provided manifest.
+func (a *applySource) config(ctx context.Context, raw []byte, mime string) (*imgspecv1.Image, error) {
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing archive manifest: %w", err)
+	}
+	blob, _, err := a.ImageSource.GetBlob(ctx, man.ConfigInfo(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image config: %w", err)
+	}
+	defer blob.Close()
+	var config imgspecv1.Image
+	if err := json.NewDecoder(blob).Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing image config: %w", err)
+	}
+	return &config, nil
+}
+
+// layerMediaType returns the oci media type of the base layer, detecting its
+// compression from its content. Base manifests can't be trusted for this, the
+// docker-archive transport for instance describes uncompressed layers as gzip.
+func (a *applySource) layerMediaType(ctx context.Context, info types.BlobInfo) (string, error) {
+	blob, _, err := a.base.GetBlob(ctx, info, nil)
+	if err != nil {
+		return "", fmt.Errorf("error reading base layer %s: %w", info.Digest, err)
+	}
+	defer blob.Close()
+	algo, decompressor, _, err := compression.DetectCompressionFormat(blob)
+	if err != nil {
+		return "", fmt.Errorf("error detecting base layer %s compression: %w", info.Digest, err)
+	}
+	switch {
+	case decompressor == nil:
+		return imgspecv1.MediaTypeImageLayer, nil
+	case algo.Name() == compression.Gzip.Name():
+		return imgspecv1.MediaTypeImageLayerGzip, nil
+	case algo.Name() == compression.Zstd.Name():
+		return imgspecv1.MediaTypeImageLayerZstd, nil
+	}
+	return "", fmt.Errorf("base layer %s uses %s compression, not supported by oci", info.Digest, algo.Name())
+}
+
+// hasBlob returns true if the blob can be read from the provided source.
+func (a *applySource) hasBlob(ctx context.Context, src types.ImageSource, dgst digest.Digest) bool {
+	blob, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: dgst, Size: -1}, nil)
+	if err != nil {
+		return false
+	}
+	blob.Close()
+	return true
+}
+
+// GetManifest returns the manifest of the complete image.
+func (a *applySource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest != nil {
+		return nil, "", fmt.Errorf("manifest %s not found", instanceDigest)
+	}
+	return a.manifest, a.mime, nil
+}
+
+// GetBlob reads the blob from the archive or, if not present there, from the base.
+func (a *applySource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	blob, size, err := a.ImageSource.GetBlob(ctx, info, cache)
+	if err == nil {
+		return blob, size, nil
+	}
+	return a.base.GetBlob(ctx, info, cache)
+}
+
+// Close closes both the archive and the base sources.
+func (a *applySource) Close() error {
+	err := a.ImageSource.Close()
+	if berr := a.base.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// baseLayers returns the layers of the base image indexed by their diff ids and
+// the base platform. If the base is a manifest list the image for the running
+// platform is used.
+func baseLayers(ctx context.Context, src types.ImageSource) (map[digest.Digest]types.BlobInfo, *types.SystemContext, error) {
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing manifest list: %w", err)
+		}
+		instance, err := list.ChooseInstance(&types.SystemContext{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error choosing image: %w", err)
+		}
+		if raw, mime, err = src.GetManifest(ctx, &instance); err != nil {
+			return nil, nil, fmt.Errorf("error reading manifest %s: %w", instance, err)
+		}
+	}
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	blob, _, err := src.GetBlob(ctx, man.ConfigInfo(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading config: %w", err)
+	}
+	defer blob.Close()
+	var config imgspecv1.Image
+	if err := json.NewDecoder(blob).Decode(&config); err != nil {
+		return nil, nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	infos := man.LayerInfos()
+	if len(infos) != len(config.RootFS.DiffIDs) {
+		return nil, nil, fmt.Errorf("config lists %d diff ids for %d layers", len(config.RootFS.DiffIDs), len(infos))
+	}
+	layers := map[digest.Digest]types.BlobInfo{}
+	for i, info := range infos {
+		layers[config.RootFS.DiffIDs[i]] = info.BlobInfo
+	}
+	platform := &types.SystemContext{
+		ArchitectureChoice: config.Architecture,
+		OSChoice:           config.OS,
+		VariantChoice:      config.Variant,
+	}
+	return layers, platform, nil
+}
@@ -0,0 +1,158 @@
+package imo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// writeDiffArchive writes an archive holding the provided manifest, without the
+// base layer, and returns its path.
+func writeDiffArchive(t *testing.T, dir string, layout *testLayout, desc imgspecv1.Descriptor, omitted digest.Digest) string {
+	layout.tag(t, "", desc)
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs", "sha256", omitted.Encoded())))
+	md := Metadata{Images: []ImageMetadata{{Final: "app", Omitted: []digest.Digest{omitted}}}}
+	require.NoError(t, writeMetadata(dir, md))
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(dir, tpath), "unable to create tarball")
+	return tpath
+}
+
+func TestApply(t *testing.T) {
+	basedir := t.TempDir()
+	baselayout := newTestLayout(t, basedir)
+	baselayout.tag(t, "v1", baselayout.image(t, "amd64", "base"))
+
+	diffdir := t.TempDir()
+	difflayout := newTestLayout(t, diffdir)
+	final := difflayout.image(t, "amd64", "base", "top")
+	tpath := writeDiffArchive(t, diffdir, difflayout, final, digest.FromString("base"))
+
+	out := t.TempDir()
+	err := New().Apply(context.Background(), "oci:"+basedir+":v1", tpath, "oci:"+out+":v2")
+	require.NoError(t, err, "unable to apply archive")
+	dgst, _ := readManifest(t, out)
+	assert.Equal(t, final.Digest, dgst, "reconstructed image differs from the final image")
+}
+
+// writeRecompressedArchive writes an archive whose final image stores the "base"
+// layer gzip compressed, leaving that layer out. Returns the archive path, the final
+// image manifest and its top layer.
+func writeRecompressedArchive(t *testing.T) (string, imgspecv1.Manifest, imgspecv1.Descriptor) {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write([]byte("base"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	diffdir := t.TempDir()
+	difflayout := newTestLayout(t, diffdir)
+	compressed := difflayout.blob(t, imgspecv1.MediaTypeImageLayerGzip, buf.Bytes())
+	top := difflayout.blob(t, imgspecv1.MediaTypeImageLayer, []byte("top"))
+	config := imgspecv1.Image{
+		Platform: imgspecv1.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS: imgspecv1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("base"), top.Digest},
+		},
+	}
+	man := imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    difflayout.json(t, imgspecv1.MediaTypeImageConfig, config),
+		Layers:    []imgspecv1.Descriptor{compressed, top},
+	}
+	final := difflayout.json(t, imgspecv1.MediaTypeImageManifest, man)
+	return writeDiffArchive(t, diffdir, difflayout, final, compressed.Digest), man, top
+}
+
+func TestApplyRecompressedBase(t *testing.T) {
+	basedir := t.TempDir()
+	baselayout := newTestLayout(t, basedir)
+	baselayout.tag(t, "v1", baselayout.image(t, "amd64", "base"))
+	tpath, man, top := writeRecompressedArchive(t)
+
+	out := t.TempDir()
+	err := New().Apply(context.Background(), "oci:"+basedir+":v1", tpath, "oci:"+out)
+	require.NoError(t, err, "unable to apply archive")
+	_, applied := readManifest(t, out)
+	assert.Equal(t, man.Config.Digest, applied.Config.Digest, "image config changed")
+	require.Len(t, applied.Layers, 2)
+	assert.Equal(t, digest.FromString("base"), applied.Layers[0].Digest, "base layer not used")
+	assert.Equal(t, imgspecv1.MediaTypeImageLayer, applied.Layers[0].MediaType, "base layer is not compressed")
+	assert.Equal(t, top.Digest, applied.Layers[1].Digest)
+
+	// without the base layer the archive can't be applied.
+	emptydir := t.TempDir()
+	emptylayout := newTestLayout(t, emptydir)
+	emptylayout.tag(t, "v1", emptylayout.image(t, "amd64", "other"))
+	err = New().Apply(context.Background(), "oci:"+emptydir+":v1", tpath, "oci:"+t.TempDir())
+	assert.ErrorContains(t, err, "found neither in the archive nor in the base image")
+}
+
+func TestApplyDockerArchive(t *testing.T) {
+	ctx := context.Background()
+	basedir := t.TempDir()
+	baselayout := newTestLayout(t, basedir)
+	baselayout.tag(t, "v1", baselayout.image(t, "amd64", "base"))
+	base := filepath.Join(t.TempDir(), "base.tar")
+	srcref, err := alltransports.ParseImageName("oci:" + basedir + ":v1")
+	require.NoError(t, err, "unable to parse base layout")
+	baseref, err := alltransports.ParseImageName("docker-archive:" + base)
+	require.NoError(t, err, "unable to parse base archive")
+	polctx, err := policyContext()
+	require.NoError(t, err, "unable to create policy context")
+	_, err = copy.Image(ctx, polctx, baseref, srcref, &copy.Options{})
+	require.NoError(t, err, "unable to write docker archive base")
+	tpath, man, top := writeRecompressedArchive(t)
+
+	// docker-archive describes its uncompressed layers as gzip compressed.
+	out := t.TempDir()
+	require.NoError(t, New().Apply(ctx, "docker-archive:"+base, tpath, "oci:"+out), "unable to apply archive")
+	_, applied := readManifest(t, out)
+	assert.Equal(t, man.Config.Digest, applied.Config.Digest, "image config changed")
+	require.Len(t, applied.Layers, 2)
+	assert.Equal(t, digest.FromString("base"), applied.Layers[0].Digest, "base layer not used")
+	assert.Equal(t, imgspecv1.MediaTypeImageLayer, applied.Layers[0].MediaType, "base layer is not compressed")
+	assert.Equal(t, top.Digest, applied.Layers[1].Digest)
+
+	output := filepath.Join(t.TempDir(), "final.tar")
+	require.NoError(t, New().Apply(ctx, "docker-archive:"+base, tpath, "docker-archive:"+output), "unable to apply archive")
+	outref, err := alltransports.ParseImageName("docker-archive:" + output)
+	require.NoError(t, err, "unable to parse output archive")
+	src, err := outref.NewImageSource(ctx, &types.SystemContext{})
+	require.NoError(t, err, "unable to open output archive")
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err, "unable to read output manifest")
+	parsed, err := manifest.FromBlob(raw, mime)
+	require.NoError(t, err, "unable to parse output manifest")
+	layers := parsed.LayerInfos()
+	require.Len(t, layers, 2)
+	for i, content := range []string{"base", "top"} {
+		blob, _, err := src.GetBlob(ctx, layers[i].BlobInfo, nil)
+		require.NoError(t, err, "unable to read output layer")
+		data, err := io.ReadAll(blob)
+		blob.Close()
+		require.NoError(t, err, "unable to read output layer")
+		assert.Equal(t, content, string(data), "unexpected output layer content")
+	}
+}
+
+func TestApplyRemoteReferences(t *testing.T) {
+	err := New().Apply(context.Background(), "docker://registry.example.com/app:v1", "unused.tar", "oci:/tmp/out")
+	assert.ErrorContains(t, err, "is not a local reference")
+}
@@ -0,0 +1,141 @@
+package imo
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tarball writes the content of the src directory as an uncompressed tarball
+// into dst. Entries are stored relative to src, this is the format expected
+// by the oci-archive transport.
+func tarball(src, dst string) error {
+	fp, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating tarball: %w", err)
+	}
+	defer fp.Close()
+	if err := writeTar(src, fp); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// writeTar walks the src directory and writes all its entries as a tarball
+// into the provided writer.
+func writeTar(src string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := filepath.WalkDir(src, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fpath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.Copy(tw, fp)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error writing tarball: %w", err)
+	}
+	return tw.Close()
+}
+
+// untar extracts the tarball pointed by src into the dst directory. Only
+// directories and regular files are extracted, other entry types are
+// ignored.
+func untar(src, dst string) error {
+	fp, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening tarball: %w", err)
+	}
+	defer fp.Close()
+	return readTar(fp, dst)
+}
+
+// readTar extracts the tarball read from r into the dst directory.
+func readTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading tarball: %w", err)
+		}
+		fpath, err := tarEntryPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fpath, 0o755); err != nil {
+				return fmt.Errorf("error creating directory: %w", err)
+			}
+		case tar.TypeReg:
+			if err := extractFile(tr, fpath); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractFile writes the content read from r into a file at fpath, creating
+// the parent directories as needed.
+func extractFile(r io.Reader, fpath string) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0o755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	fp, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer fp.Close()
+	if _, err := io.Copy(fp, r); err != nil {
+		return fmt.Errorf("error extracting file: %w", err)
+	}
+	return fp.Close()
+}
+
+// tarEntryPath returns the path, inside dst, where a tarball entry should be
+// extracted. Returns an error if the entry attempts to escape dst.
+func tarEntryPath(dst, name string) (string, error) {
+	dst = filepath.Clean(dst)
+	fpath := filepath.Join(dst, filepath.FromSlash(name))
+	if fpath != dst && !strings.HasPrefix(fpath, dst+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid tarball entry %q", name)
+	}
+	return fpath, nil
+}
@@ -0,0 +1,48 @@
+package imo
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarballRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	err := os.MkdirAll(filepath.Join(src, "blobs", "sha256"), 0o755)
+	require.NoError(t, err, "unable to create blobs directory")
+	err = os.WriteFile(filepath.Join(src, "index.json"), []byte("{}"), 0o644)
+	require.NoError(t, err, "unable to write index")
+	err = os.WriteFile(filepath.Join(src, "blobs", "sha256", "abc"), []byte("blob"), 0o644)
+	require.NoError(t, err, "unable to write blob")
+
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err = tarball(src, tpath)
+	require.NoError(t, err, "unable to create tarball")
+
+	dst := t.TempDir()
+	err = untar(tpath, dst)
+	require.NoError(t, err, "unable to extract tarball")
+	data, err := os.ReadFile(filepath.Join(dst, "index.json"))
+	assert.NoError(t, err, "index not extracted")
+	assert.Equal(t, "{}", string(data))
+	data, err = os.ReadFile(filepath.Join(dst, "blobs", "sha256", "abc"))
+	assert.NoError(t, err, "blob not extracted")
+	assert.Equal(t, "blob", string(data))
+}
+
+func TestReadTarRejectsEscapingEntries(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	err := tw.WriteHeader(&tar.Header{Name: "../evil", Mode: 0o644, Size: 4, Typeflag: tar.TypeReg})
+	require.NoError(t, err, "unable to write header")
+	_, err = tw.Write([]byte("evil"))
+	require.NoError(t, err, "unable to write content")
+	require.NoError(t, tw.Close(), "unable to close tar writer")
+	err = readTar(buf, t.TempDir())
+	assert.Error(t, err, "escaping entry should be rejected")
+}
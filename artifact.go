@@ -0,0 +1,106 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// manifestReader reads the manifest with the provided digest, returning its content
+// and media type.
+type manifestReader func(digest.Digest) ([]byte, string, error)
+
+// isArtifact returns true if the manifest describes an OCI artifact other than a
+// container image (e.g. a Helm chart or a WASM module), that is a manifest with
+// an artifact type or with a config that is not an image configuration.
+func isArtifact(raw []byte, mime string) bool {
+	if mime != imgspecv1.MediaTypeImageManifest {
+		return false
+	}
+	var man imgspecv1.Manifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return false
+	}
+	return man.ArtifactType != "" || man.Config.MediaType != imgspecv1.MediaTypeImageConfig
+}
+
+// selectionFor returns the image list selection to use when copying an image whose
+// top level manifest is raw. Manifest lists holding only artifacts (e.g. WASM
+// modules built for multiple runtimes) don't necessarily hold an instance for the
+// running platform, in that case all their instances are copied. Children manifests
+// are read, only if needed, using the provided reader.
+func (inc *Incremental) selectionFor(raw []byte, mime string, child manifestReader) (copy.ImageListSelection, error) {
+	if inc.selection != copy.CopySystemImage || !manifest.MIMETypeIsMultiImage(mime) {
+		return inc.selection, nil
+	}
+	list, err := manifest.ListFromBlob(raw, mime)
+	if err != nil {
+		return inc.selection, fmt.Errorf("error parsing manifest list: %w", err)
+	}
+	if _, err := list.ChooseInstance(&types.SystemContext{}); err == nil {
+		return inc.selection, nil
+	}
+	for _, instance := range list.Instances() {
+		raw, mime, err := child(instance)
+		if err != nil {
+			return inc.selection, fmt.Errorf("error reading manifest %s: %w", instance, err)
+		}
+		if !isArtifact(raw, mime) {
+			return inc.selection, nil
+		}
+	}
+	return copy.CopyAllImages, nil
+}
+
+// sourceSelection returns the image list selection to use when copying the image
+// pointed by ref, accessed using the provided system context. See selectionFor.
+func (inc *Incremental) sourceSelection(ctx context.Context, ref types.ImageReference, sysctx *types.SystemContext) (copy.ImageListSelection, error) {
+	if inc.selection != copy.CopySystemImage {
+		return inc.selection, nil
+	}
+	src, err := ref.NewImageSource(ctx, sysctx)
+	if err != nil {
+		return inc.selection, fmt.Errorf("error creating source image: %w", err)
+	}
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return inc.selection, fmt.Errorf("error reading manifest: %w", err)
+	}
+	return inc.selectionFor(raw, mime, func(dgst digest.Digest) ([]byte, string, error) {
+		return src.GetManifest(ctx, &dgst)
+	})
+}
+
+// archiveSelection returns the image list selection to use when pushing the image
+// read from an archive. See selectionFor.
+func (inc *Incremental) archiveSelection(content *archiveContent) (copy.ImageListSelection, error) {
+	var index imgspecv1.Index
+	if err := json.Unmarshal(content.index, &index); err != nil {
+		return inc.selection, fmt.Errorf("error parsing %s: %w", imgspecv1.ImageIndexFile, err)
+	}
+	if len(index.Manifests) != 1 {
+		return inc.selection, nil
+	}
+	reader := func(dgst digest.Digest) ([]byte, string, error) {
+		raw, ok := content.small[dgst]
+		if !ok {
+			return nil, "", fmt.Errorf("manifest %s not found in archive", dgst)
+		}
+		return raw, manifest.GuessMIMEType(raw), nil
+	}
+	raw, mime, err := reader(index.Manifests[0].Digest)
+	if err != nil {
+		return inc.selection, err
+	}
+	if index.Manifests[0].MediaType != "" {
+		mime = index.Manifests[0].MediaType
+	}
+	return inc.selectionFor(raw, mime, reader)
+}
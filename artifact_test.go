@@ -0,0 +1,145 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// wasm writes into the layout a WASM module artifact with the provided layers
+// contents and returns the descriptor for its manifest.
+func (l *testLayout) wasm(t *testing.T, system string, layers ...string) imgspecv1.Descriptor {
+	descs := []imgspecv1.Descriptor{}
+	for _, layer := range layers {
+		descs = append(descs, l.blob(t, "application/vnd.wasm.content.layer.v1+wasm", []byte(layer)))
+	}
+	man := imgspecv1.Manifest{
+		Versioned:    imgspecs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.wasm.config.v1+json",
+		Config:       l.blob(t, imgspecv1.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       descs,
+	}
+	desc := l.json(t, imgspecv1.MediaTypeImageManifest, man)
+	desc.Platform = &imgspecv1.Platform{Architecture: "wasm", OS: system}
+	return desc
+}
+
+// chart writes into the layout a Helm chart artifact with the provided layers
+// contents and returns the descriptor for its manifest.
+func (l *testLayout) chart(t *testing.T, layers ...string) imgspecv1.Descriptor {
+	descs := []imgspecv1.Descriptor{}
+	for _, layer := range layers {
+		descs = append(descs, l.blob(t, "application/vnd.cncf.helm.chart.content.v1.tar+gzip", []byte(layer)))
+	}
+	man := imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    l.blob(t, "application/vnd.cncf.helm.config.v1+json", []byte(`{"name":"chart"}`)),
+		Layers:    descs,
+	}
+	return l.json(t, imgspecv1.MediaTypeImageManifest, man)
+}
+
+// pullArtifact pulls the artifact stored in the oci layout in src, omitting the
+// layers present in the oci layout in base, into a new oci layout. Returns the
+// new layout directory, the writer used and the copy error.
+func pullArtifact(t *testing.T, base, src string) (string, *Writer, error) {
+	ctx := context.Background()
+	baseref, err := alltransports.ParseImageName("oci:" + base)
+	require.NoError(t, err, "unable to parse base")
+	srcref, err := alltransports.ParseImageName("oci:" + src)
+	require.NoError(t, err, "unable to parse source")
+	dst := t.TempDir()
+	dstref, err := alltransports.ParseImageName("oci:" + dst)
+	require.NoError(t, err, "unable to parse destination")
+	writer, err := NewWriter(ctx, baseref, dstref, &types.SystemContext{})
+	require.NoError(t, err, "unable to create writer")
+	err = New().copyImage(ctx, writer, srcref, &types.SystemContext{})
+	return dst, writer, err
+}
+
+func TestIsArtifact(t *testing.T) {
+	layout := newTestLayout(t, t.TempDir())
+	for _, tt := range []struct {
+		name     string
+		desc     imgspecv1.Descriptor
+		artifact bool
+	}{
+		{name: "image", desc: layout.image(t, "amd64", "base"), artifact: false},
+		{name: "wasm module", desc: layout.wasm(t, "wasip1", "module"), artifact: true},
+		{name: "helm chart", desc: layout.chart(t, "chart"), artifact: true},
+		{name: "list", desc: layout.list(t, layout.image(t, "amd64", "base")), artifact: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join(layout.dir, "blobs", "sha256", tt.desc.Digest.Encoded()))
+			require.NoError(t, err, "unable to read manifest")
+			assert.Equal(t, tt.artifact, isArtifact(raw, tt.desc.MediaType))
+		})
+	}
+}
+
+func TestPullChart(t *testing.T) {
+	base := t.TempDir()
+	blayout := newTestLayout(t, base)
+	blayout.tag(t, "", blayout.chart(t, "templates", "values"))
+	src := t.TempDir()
+	slayout := newTestLayout(t, src)
+	desc := slayout.chart(t, "templates", "values-v2")
+	slayout.tag(t, "", desc)
+
+	dst, writer, err := pullArtifact(t, base, src)
+	require.NoError(t, err, "unable to pull chart")
+	dgst, man := readManifest(t, dst)
+	assert.Equal(t, desc.Digest, dgst, "chart manifest should be kept as is")
+	assert.Equal(t, "application/vnd.cncf.helm.config.v1+json", man.Config.MediaType)
+	assert.Equal(t, []digest.Digest{man.Layers[0].Digest}, writer.Omitted(), "shared layer should be omitted")
+	_, err = os.Stat(filepath.Join(dst, "blobs", "sha256", man.Layers[1].Digest.Encoded()))
+	assert.NoError(t, err, "new chart layer should be copied")
+}
+
+func TestPullWasmList(t *testing.T) {
+	base := t.TempDir()
+	blayout := newTestLayout(t, base)
+	blayout.tag(t, "", blayout.list(t, blayout.wasm(t, "wasip1", "runtime", "v1")))
+	src := t.TempDir()
+	slayout := newTestLayout(t, src)
+	desc := slayout.list(t, slayout.wasm(t, "wasip1", "runtime", "v2"), slayout.wasm(t, "wasip2", "runtime", "v2-p2"))
+	slayout.tag(t, "", desc)
+
+	dst, writer, err := pullArtifact(t, base, src)
+	require.NoError(t, err, "unable to pull wasm modules")
+	assert.Len(t, writer.Omitted(), 1, "shared runtime layer should be omitted")
+	data, err := os.ReadFile(filepath.Join(dst, imgspecv1.ImageIndexFile))
+	require.NoError(t, err, "unable to read index")
+	var index imgspecv1.Index
+	require.NoError(t, json.Unmarshal(data, &index), "unable to parse index")
+	require.Len(t, index.Manifests, 1, "unexpected number of images")
+	assert.Equal(t, desc.Digest, index.Manifests[0].Digest, "all modules should be copied")
+
+	image := newTestLayout(t, t.TempDir())
+	raw, err := json.Marshal(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{image.image(t, "s390x", "base")},
+	})
+	require.NoError(t, err, "unable to marshal index")
+	inc := New()
+	selection, err := inc.selectionFor(raw, imgspecv1.MediaTypeImageIndex, func(dgst digest.Digest) ([]byte, string, error) {
+		raw, err := os.ReadFile(filepath.Join(image.dir, "blobs", "sha256", dgst.Encoded()))
+		return raw, imgspecv1.MediaTypeImageManifest, err
+	})
+	require.NoError(t, err, "unable to determine selection")
+	assert.Equal(t, copy.CopySystemImage, selection, "image lists should keep the configured selection")
+}
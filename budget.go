@@ -0,0 +1,209 @@
+package imo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/types"
+)
+
+// RequestBudget limits the requests sent to a registry to Requests per Period.
+// Requests can be sent in bursts as long as the budget is not exhausted. The
+// budget counts registry operations (e.g. reading a manifest, uploading a blob or
+// resolving a tag) rather than the individual HTTP requests they need.
+type RequestBudget struct {
+	Requests int
+	Period   time.Duration
+}
+
+// requestLimiter is a token bucket enforcing a RequestBudget.
+type requestLimiter struct {
+	mtx    sync.Mutex
+	clock  clock
+	budget RequestBudget
+	tokens float64
+	last   time.Time
+}
+
+// newRequestLimiter returns a requestLimiter for the budget, as measured by the
+// provided clock, starting with the whole budget available.
+func newRequestLimiter(budget RequestBudget, clock clock) *requestLimiter {
+	return &requestLimiter{
+		clock:  clock,
+		budget: budget,
+		tokens: float64(budget.Requests),
+		last:   clock.Now(),
+	}
+}
+
+// reserve consumes a request from the budget and returns how long the caller must
+// wait before sending it.
+func (r *requestLimiter) reserve() time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.budget.Requests <= 0 || r.budget.Period <= 0 {
+		return 0
+	}
+	rate := float64(r.budget.Requests) / r.budget.Period.Seconds()
+	now := r.clock.Now()
+	r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*rate, float64(r.budget.Requests))
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / rate * float64(time.Second))
+}
+
+// budgets holds the request budgets for the registries and the limiters enforcing
+// them, limiters are created as registries are contacted.
+type budgets struct {
+	mtx      sync.Mutex
+	clock    clock
+	budgets  map[string]RequestBudget
+	limiters map[string]*requestLimiter
+}
+
+// limiter returns the limiter for the registry. Registries without a budget of
+// their own use the default one (set for the empty registry name), if any.
+func (b *budgets) limiter(registry string) *requestLimiter {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if limiter, ok := b.limiters[registry]; ok {
+		return limiter
+	}
+	budget, ok := b.budgets[registry]
+	if !ok {
+		if budget, ok = b.budgets[""]; !ok {
+			return nil
+		}
+	}
+	limiter := newRequestLimiter(budget, b.clock)
+	b.limiters[registry] = limiter
+	return limiter
+}
+
+// spend consumes a request from the budget of the registry, waiting until the
+// budget allows it or the context is done. Waits are reported to the report
+// writer.
+func (inc *Incremental) spend(ctx context.Context, registry string) error {
+	if inc.budgets == nil {
+		return nil
+	}
+	limiter := inc.budgets.limiter(registry)
+	if limiter == nil {
+		return nil
+	}
+	delay := limiter.reserve()
+	if delay == 0 {
+		return nil
+	}
+	if delay >= time.Second {
+		fmt.Fprintf(inc.report, "request budget for %s exhausted, waiting %s\n", registry, delay.Round(time.Second))
+	}
+	return limiter.clock.Sleep(ctx, delay)
+}
+
+// budgeted wraps the reference so the operations against the registry consume
+// its request budget. References not pointing to registries, or to registries
+// without a budget, are returned as they are.
+func (inc *Incremental) budgeted(ref types.ImageReference) types.ImageReference {
+	if inc.budgets == nil || ref.Transport().Name() != "docker" || ref.DockerReference() == nil {
+		return ref
+	}
+	registry := reference.Domain(ref.DockerReference())
+	if inc.budgets.limiter(registry) == nil {
+		return ref
+	}
+	return &budgetedReference{ImageReference: ref, inc: inc, registry: registry}
+}
+
+// budgetedReference is an image reference whose sources and destinations consume
+// the registry request budget.
+type budgetedReference struct {
+	types.ImageReference
+	inc      *Incremental
+	registry string
+}
+
+// NewImageSource returns an image source consuming the request budget.
+func (b *budgetedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	if err := b.inc.spend(ctx, b.registry); err != nil {
+		return nil, err
+	}
+	src, err := b.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &budgetedSource{ImageSource: src, ref: b}, nil
+}
+
+// NewImageDestination returns an image destination consuming the request budget.
+func (b *budgetedReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	if err := b.inc.spend(ctx, b.registry); err != nil {
+		return nil, err
+	}
+	dest, err := b.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &budgetedDestination{ImageDestination: dest, ref: b}, nil
+}
+
+// budgetedSource is an image source whose reads consume the request budget.
+type budgetedSource struct {
+	types.ImageSource
+	ref *budgetedReference
+}
+
+// GetManifest reads the manifest once the budget allows it.
+func (b *budgetedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if err := b.ref.inc.spend(ctx, b.ref.registry); err != nil {
+		return nil, "", err
+	}
+	return b.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+// GetBlob reads the blob once the budget allows it.
+func (b *budgetedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if err := b.ref.inc.spend(ctx, b.ref.registry); err != nil {
+		return nil, 0, err
+	}
+	return b.ImageSource.GetBlob(ctx, info, cache)
+}
+
+// budgetedDestination is an image destination whose writes consume the request
+// budget.
+type budgetedDestination struct {
+	types.ImageDestination
+	ref *budgetedReference
+}
+
+// PutBlob writes the blob once the budget allows it.
+func (b *budgetedDestination) PutBlob(ctx context.Context, stream io.Reader, info types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if err := b.ref.inc.spend(ctx, b.ref.registry); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return b.ImageDestination.PutBlob(ctx, stream, info, cache, isConfig)
+}
+
+// TryReusingBlob checks for the blob once the budget allows it.
+func (b *budgetedDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, substitute bool) (bool, types.BlobInfo, error) {
+	if err := b.ref.inc.spend(ctx, b.ref.registry); err != nil {
+		return false, types.BlobInfo{}, err
+	}
+	return b.ImageDestination.TryReusingBlob(ctx, info, cache, substitute)
+}
+
+// PutManifest writes the manifest once the budget allows it.
+func (b *budgetedDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	if err := b.ref.inc.spend(ctx, b.ref.registry); err != nil {
+		return err
+	}
+	return b.ImageDestination.PutManifest(ctx, manifest, instanceDigest)
+}
@@ -0,0 +1,63 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newRequestLimiter(RequestBudget{Requests: 2, Period: time.Second}, clock)
+	assert.Zero(t, limiter.reserve(), "first request should be within the budget")
+	assert.Zero(t, limiter.reserve(), "second request should be within the budget")
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve(), "exhausted budget should delay requests")
+	clock.now = clock.now.Add(time.Second)
+	assert.Zero(t, limiter.reserve(), "budget should be refilled over time")
+
+	unlimited := newRequestLimiter(RequestBudget{}, clock)
+	for range 10 {
+		assert.Zero(t, unlimited.reserve(), "empty budget should not limit requests")
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	report := bytes.NewBuffer(nil)
+	inc := New(
+		WithReporterWriter(report),
+		WithRequestBudget("", RequestBudget{Requests: 1, Period: time.Hour}),
+		WithRequestBudget("quay.io", RequestBudget{Requests: 100, Period: time.Second}),
+	)
+	clock := &fakeClock{now: time.Now()}
+	inc.budgets.clock = clock
+	assert.NotSame(t, inc.budgets.limiter("docker.io"), inc.budgets.limiter("ghcr.io"), "default budget should apply per registry")
+	assert.Same(t, inc.budgets.limiter("quay.io"), inc.budgets.limiter("quay.io"), "limiters should be reused")
+
+	ctx := context.Background()
+	for range 10 {
+		require.NoError(t, inc.spend(ctx, "quay.io"), "registry budget should not be exhausted")
+	}
+	assert.Zero(t, clock.Slept(), "requests within the budget should not wait")
+	require.NoError(t, inc.spend(ctx, "docker.io"), "first request should be within the budget")
+	require.NoError(t, inc.spend(ctx, "docker.io"), "exhausted budget should wait")
+	assert.Equal(t, time.Hour, clock.Slept().Round(time.Second), "exhausted budget should wait for a refill")
+	assert.Contains(t, report.String(), "request budget for docker.io exhausted", "long waits should be reported")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, inc.spend(cancelled, "docker.io"), context.Canceled, "waits should honor the context")
+
+	ref, err := alltransports.ParseImageName("docker://quay.io/repo/image:latest")
+	require.NoError(t, err, "unable to parse reference")
+	assert.IsType(t, &budgetedReference{}, inc.budgeted(ref), "registry references should be budgeted")
+	ref, err = alltransports.ParseImageName("oci:" + t.TempDir())
+	require.NoError(t, err, "unable to parse reference")
+	assert.Equal(t, ref, inc.budgeted(ref), "local references should not be budgeted")
+	ref, err = alltransports.ParseImageName("docker://quay.io/repo/image:latest")
+	require.NoError(t, err, "unable to parse reference")
+	assert.Equal(t, ref, New().budgeted(ref), "references should not be budgeted without budgets")
+}
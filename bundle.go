@@ -0,0 +1,141 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/google/uuid"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// BundleEntry describes one of the images part of a bundle. Name identifies the
+// image inside the bundle archive while Base and Final are the images between
+// which the incremental difference is calculated. As with Pull, Base can be set
+// to 'scratch' in order to include all the layers of the Final image.
+type BundleEntry struct {
+	Name  string
+	Base  string
+	Final string
+}
+
+// PullBundle pulls the incremental difference of multiple images into a single
+// oci-archive tarball. Blobs shared among the images (e.g. common base layers)
+// are stored only once and the archive index lists each image under its entry
+// name. The caller is responsible for closing the returned Diff.
+func (inc *Incremental) PullBundle(ctx context.Context, entries []BundleEntry) (*Diff, error) {
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("bundle entry for %s has no name", entry.Final)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("duplicated bundle entry %s", entry.Name)
+		}
+		seen[entry.Name] = true
+	}
+	dir := path.Join(inc.tmpdir, uuid.New().String())
+	defer os.RemoveAll(dir)
+	md := Metadata{}
+	for _, entry := range entries {
+		dstref, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s:%s", dir, entry.Name))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing destination reference for %s: %w", entry.Name, err)
+		}
+		imgmd, index, err := inc.pullInto(ctx, dstref, entry.Base, entry.Final)
+		if err != nil {
+			return nil, fmt.Errorf("error pulling %s: %w", entry.Name, err)
+		}
+		imgmd.Name = entry.Name
+		if inc.referrers {
+			if err := inc.pullReferrers(ctx, dir, index, &imgmd); err != nil {
+				return nil, fmt.Errorf("error pulling %s referrers: %w", entry.Name, err)
+			}
+		}
+		md.Images = append(md.Images, imgmd)
+	}
+	return inc.archive(dir, md)
+}
+
+// PushBundle pushes all the images stored in the bundle pointed by src. The dsts
+// map relates each image name in the bundle with its destination reference, all
+// images in the bundle must have a destination. The bundle is verified (see Verify
+// and WithTrustedKeys) before anything is sent to the registry. The bundle is
+// extracted only once and all images are pushed from the extracted content.
+// Returns the result of the push for each image, indexed by image name. Referrers
+// are re-attached as on Push.
+func (inc *Incremental) PushBundle(ctx context.Context, src string, dsts map[string]string) (map[string]*PushResult, error) {
+	src, cleanup, err := inc.decryptArchive(src)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	content, err := inc.readVerified(src)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying bundle: %w", err)
+	}
+	dir := path.Join(inc.tmpdir, uuid.New().String())
+	defer os.RemoveAll(dir)
+	if err := untar(src, dir); err != nil {
+		return nil, fmt.Errorf("error extracting bundle: %w", err)
+	}
+	names, err := bundleNames(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading bundle index: %w", err)
+	}
+	for _, name := range names {
+		if _, ok := dsts[name]; !ok {
+			return nil, fmt.Errorf("no destination for bundle image %s", name)
+		}
+	}
+	referrers := map[string][]Referrer{}
+	if inc.referrers && content.metadata != nil {
+		for _, img := range content.metadata.Images {
+			referrers[img.Name] = img.Referrers
+		}
+	}
+	results := map[string]*PushResult{}
+	for _, name := range names {
+		srcref, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s:%s", dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing source reference for %s: %w", name, err)
+		}
+		selection, err := inc.sourceSelection(ctx, srcref, &types.SystemContext{})
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting %s: %w", name, err)
+		}
+		if results[name], err = inc.pushFrom(ctx, srcref, dsts[name], selection); err != nil {
+			return nil, fmt.Errorf("error pushing %s: %w", name, err)
+		}
+		if err := inc.pushReferrers(ctx, srcref, dsts[name], referrers[name]); err != nil {
+			return nil, fmt.Errorf("error pushing %s referrers: %w", name, err)
+		}
+	}
+	return results, nil
+}
+
+// bundleNames returns the names of all images listed in the index of the oci
+// layout stored in dir.
+func bundleNames(dir string) ([]string, error) {
+	data, err := os.ReadFile(path.Join(dir, imgspecv1.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, desc := range index.Manifests {
+		name, ok := desc.Annotations[imgspecv1.AnnotationRefName]
+		if !ok {
+			return nil, fmt.Errorf("image %s has no name", desc.Digest)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,40 @@
+package imo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullBundleInvalidEntries(t *testing.T) {
+	inc := New()
+	_, err := inc.PullBundle(context.Background(), []BundleEntry{
+		{Base: "scratch", Final: "docker.io/alpine:latest"},
+	})
+	assert.Error(t, err, "entries without name should be rejected")
+	_, err = inc.PullBundle(context.Background(), []BundleEntry{
+		{Name: "alpine", Base: "scratch", Final: "docker.io/alpine:3.19"},
+		{Name: "alpine", Base: "scratch", Final: "docker.io/alpine:3.20"},
+	})
+	assert.Error(t, err, "duplicated entries should be rejected")
+}
+
+func Test_bundleNames(t *testing.T) {
+	dir := t.TempDir()
+	index := `{
+		"schemaVersion": 2,
+		"manifests": [
+			{"digest": "sha256:aaaa", "annotations": {"org.opencontainers.image.ref.name": "first"}},
+			{"digest": "sha256:bbbb", "annotations": {"org.opencontainers.image.ref.name": "second"}}
+		]
+	}`
+	err := os.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0o644)
+	require.NoError(t, err, "unable to write index")
+	names, err := bundleNames(dir)
+	require.NoError(t, err, "unable to read bundle names")
+	assert.Equal(t, []string{"first", "second"}, names)
+}
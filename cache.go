@@ -0,0 +1,221 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// Cache stores registry data shared by all operations of an Incremental, so batch
+// jobs over many images don't fetch the same data over and over. Manifests are
+// immutable and are kept by digest while tag resolutions are only valid for a
+// while. BlobInfoCacheDir returns the directory where the blob info cache (used
+// by the copies to know, among others, which blobs exist in which repositories
+// and how they have been compressed) is stored, an empty string means the system
+// default. Caches are best effort: failing to store an entry is not an error.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	Manifest(dgst digest.Digest) ([]byte, string, bool)
+	PutManifest(dgst digest.Digest, raw []byte, mime string)
+	Digest(ref string) (digest.Digest, bool)
+	PutDigest(ref string, dgst digest.Digest)
+	BlobInfoCacheDir() string
+}
+
+// cachedManifest is a manifest as stored on disk by DiskCache.
+type cachedManifest struct {
+	MediaType string `json:"mediaType"`
+	Manifest  []byte `json:"manifest"`
+}
+
+// cachedDigest is a tag resolution as stored on disk by DiskCache.
+type cachedDigest struct {
+	Reference string        `json:"reference"`
+	Digest    digest.Digest `json:"digest"`
+	Resolved  time.Time     `json:"resolved"`
+}
+
+// DiskCache is a Cache storing its content in a directory, it can be shared by
+// multiple processes. Tag resolutions older than the ttl are ignored.
+type DiskCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewDiskCache returns a DiskCache storing its content in dir, the directory is
+// created if needed. Tags resolved more than ttl ago are resolved again, a ttl
+// equal or lower than zero disables the caching of tag resolutions.
+func NewDiskCache(dir string, ttl time.Duration) (*DiskCache, error) {
+	for _, sub := range []string{"manifests", "tags", "blobinfo"} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating cache directory: %w", err)
+		}
+	}
+	return &DiskCache{dir: dir, ttl: ttl}, nil
+}
+
+// Manifest returns the cached manifest with the provided digest and its media
+// type. The content is checked against the digest.
+func (d *DiskCache) Manifest(dgst digest.Digest) ([]byte, string, bool) {
+	if dgst.Validate() != nil {
+		return nil, "", false
+	}
+	var cached cachedManifest
+	if !d.read(path.Join("manifests", dgst.Encoded()), &cached) {
+		return nil, "", false
+	}
+	if ok, err := manifest.MatchesDigest(cached.Manifest, dgst); err != nil || !ok {
+		return nil, "", false
+	}
+	return cached.Manifest, cached.MediaType, true
+}
+
+// PutManifest stores the manifest with the provided digest and media type.
+func (d *DiskCache) PutManifest(dgst digest.Digest, raw []byte, mime string) {
+	if dgst.Validate() != nil {
+		return
+	}
+	d.write(path.Join("manifests", dgst.Encoded()), cachedManifest{MediaType: mime, Manifest: raw})
+}
+
+// Digest returns the digest the provided reference has been resolved to if the
+// resolution happened less than ttl ago.
+func (d *DiskCache) Digest(ref string) (digest.Digest, bool) {
+	if d.ttl <= 0 {
+		return "", false
+	}
+	var cached cachedDigest
+	if !d.read(path.Join("tags", digest.FromString(ref).Encoded()), &cached) {
+		return "", false
+	}
+	if cached.Reference != ref || time.Since(cached.Resolved) > d.ttl || cached.Digest.Validate() != nil {
+		return "", false
+	}
+	return cached.Digest, true
+}
+
+// PutDigest records that the provided reference has been resolved to dgst.
+func (d *DiskCache) PutDigest(ref string, dgst digest.Digest) {
+	if d.ttl <= 0 {
+		return
+	}
+	d.write(
+		path.Join("tags", digest.FromString(ref).Encoded()),
+		cachedDigest{Reference: ref, Digest: dgst, Resolved: time.Now()},
+	)
+}
+
+// BlobInfoCacheDir returns the directory holding the blob info cache.
+func (d *DiskCache) BlobInfoCacheDir() string {
+	return path.Join(d.dir, "blobinfo")
+}
+
+// read decodes the cache entry stored in the file pointed by name, relative to
+// the cache directory. Returns false if the entry can't be read.
+func (d *DiskCache) read(name string, obj any) bool {
+	data, err := os.ReadFile(path.Join(d.dir, name))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, obj) == nil
+}
+
+// write encodes the entry into the file pointed by name, relative to the cache
+// directory. The file is replaced atomically so concurrent readers never see a
+// partially written entry.
+func (d *DiskCache) write(name string, obj any) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+	fpath := path.Join(d.dir, name)
+	tmp := fmt.Sprintf("%s.%s", fpath, uuid.New().String())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// cached wraps the reference so manifests are read from, and stored into, the
+// configured cache. Only references to registries are wrapped.
+func (inc *Incremental) cached(ref types.ImageReference) types.ImageReference {
+	if inc.cache == nil || ref.Transport().Name() != "docker" {
+		return ref
+	}
+	return &cachedReference{ImageReference: ref, cache: inc.cache}
+}
+
+// blobInfoCacheDir returns the directory for the blob info cache used by copies.
+// Returns an empty string, meaning the system default, if no cache has been set.
+func (inc *Incremental) blobInfoCacheDir() string {
+	if inc.cache == nil {
+		return ""
+	}
+	return inc.cache.BlobInfoCacheDir()
+}
+
+// cachedReference is an image reference whose manifests are cached.
+type cachedReference struct {
+	types.ImageReference
+	cache Cache
+}
+
+// NewImageSource returns an image source whose manifests are cached.
+func (c *cachedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := c.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedSource{ImageSource: src, cache: c.cache}
+	if digested, ok := c.DockerReference().(reference.Digested); ok {
+		cached.pinned = digested.Digest()
+	}
+	return cached, nil
+}
+
+// cachedSource is an image source whose manifests are cached. Manifests are looked
+// up in the cache by digest, so the top level manifest is only served from the
+// cache if the source reference is pinned by digest.
+type cachedSource struct {
+	types.ImageSource
+	cache  Cache
+	pinned digest.Digest
+}
+
+// GetManifest returns the manifest from the cache or, if not cached, from the
+// source. Manifests read from the source are stored in the cache.
+func (c *cachedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	dgst := c.pinned
+	if instanceDigest != nil {
+		dgst = *instanceDigest
+	}
+	if dgst != "" {
+		if raw, mime, ok := c.cache.Manifest(dgst); ok {
+			return raw, mime, nil
+		}
+	}
+	raw, mime, err := c.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	if dgst == "" {
+		if dgst, err = manifest.Digest(raw); err != nil {
+			return raw, mime, nil
+		}
+	} else if ok, err := manifest.MatchesDigest(raw, dgst); err != nil || !ok {
+		return raw, mime, nil
+	}
+	c.cache.PutManifest(dgst, raw, mime)
+	return raw, mime, nil
+}
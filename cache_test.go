@@ -0,0 +1,87 @@
+package imo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestDiskCacheManifests(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir(), time.Hour)
+	require.NoError(t, err, "unable to create cache")
+	raw := []byte(`{"schemaVersion":2}`)
+	dgst := digest.FromBytes(raw)
+
+	_, _, ok := cache.Manifest(dgst)
+	assert.False(t, ok, "empty cache should not hold manifests")
+	cache.PutManifest(dgst, raw, imgspecv1.MediaTypeImageManifest)
+	cached, mime, ok := cache.Manifest(dgst)
+	require.True(t, ok, "manifest should be cached")
+	assert.Equal(t, raw, cached)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mime)
+
+	other := digest.FromString("other")
+	cache.PutManifest(other, raw, imgspecv1.MediaTypeImageManifest)
+	_, _, ok = cache.Manifest(other)
+	assert.False(t, ok, "manifests not matching their digest should be ignored")
+}
+
+func TestDiskCacheDigests(t *testing.T) {
+	dir := t.TempDir()
+	dgst := digest.FromString("image")
+	cache, err := NewDiskCache(dir, 50*time.Millisecond)
+	require.NoError(t, err, "unable to create cache")
+	cache.PutDigest("registry.example.com/image:latest", dgst)
+	cached, ok := cache.Digest("registry.example.com/image:latest")
+	require.True(t, ok, "resolution should be cached")
+	assert.Equal(t, dgst, cached)
+	_, ok = cache.Digest("registry.example.com/image:other")
+	assert.False(t, ok, "other tags should not be resolved")
+
+	time.Sleep(100 * time.Millisecond)
+	_, ok = cache.Digest("registry.example.com/image:latest")
+	assert.False(t, ok, "expired resolution should be ignored")
+
+	disabled, err := NewDiskCache(dir, 0)
+	require.NoError(t, err, "unable to create cache")
+	disabled.PutDigest("registry.example.com/image:latest", dgst)
+	_, ok = disabled.Digest("registry.example.com/image:latest")
+	assert.False(t, ok, "resolutions should not be cached without a ttl")
+}
+
+func TestCachedSource(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	child := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", layout.list(t, child))
+	ref, err := alltransports.ParseImageName("oci:" + dir)
+	require.NoError(t, err, "unable to parse reference")
+	cache, err := NewDiskCache(t.TempDir(), time.Hour)
+	require.NoError(t, err, "unable to create cache")
+	cached := &cachedReference{ImageReference: ref, cache: cache}
+
+	src, err := cached.NewImageSource(ctx, &types.SystemContext{})
+	require.NoError(t, err, "unable to create source")
+	defer src.Close()
+	raw, _, err := src.GetManifest(ctx, &child.Digest)
+	require.NoError(t, err, "unable to read manifest")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs", "sha256", child.Digest.Encoded())))
+	again, _, err := src.GetManifest(ctx, &child.Digest)
+	require.NoError(t, err, "manifest should be served from the cache")
+	assert.Equal(t, raw, again)
+
+	index := NewManifestsIndex(&types.SystemContext{})
+	require.NoError(t, index.FetchManifests(ctx, cached), "unable to index cached image")
+	assert.Len(t, index.Manifests(), 1, "cached child should be indexed")
+}
@@ -0,0 +1,89 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/pkg/compression"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// readBlob returns the content of the blob, stored in the oci layout in dir, the
+// descriptor points to.
+func readBlob(t *testing.T, dir string, desc imgspecv1.Descriptor) []byte {
+	data, err := os.ReadFile(filepath.Join(dir, "blobs", "sha256", desc.Digest.Encoded()))
+	require.NoError(t, err, "unable to read blob %s", desc.Digest)
+	return data
+}
+
+func TestArchiveCompression(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	blayout := newTestLayout(t, base)
+	blayout.tag(t, "", blayout.image(t, "amd64", "base"))
+	src := t.TempDir()
+	slayout := newTestLayout(t, src)
+	original := slayout.image(t, "amd64", "base", "top")
+	slayout.tag(t, "", original)
+	baseref, err := alltransports.ParseImageName("oci:" + base)
+	require.NoError(t, err, "unable to parse base")
+	srcref, err := alltransports.ParseImageName("oci:" + src)
+	require.NoError(t, err, "unable to parse source")
+	dst := t.TempDir()
+	dstref, err := alltransports.ParseImageName("oci:" + dst)
+	require.NoError(t, err, "unable to parse destination")
+
+	writer, err := NewWriter(ctx, baseref, dstref, &types.SystemContext{})
+	require.NoError(t, err, "unable to create writer")
+	inc := New(WithArchiveCompression(compression.Zstd, 10))
+	require.NoError(t, inc.copyImage(ctx, writer, srcref, &types.SystemContext{}), "unable to pull image")
+	_, man := readManifest(t, dst)
+	require.Len(t, man.Layers, 2)
+	assert.Equal(t, imgspecv1.MediaTypeImageLayer, man.Layers[0].MediaType, "omitted layer should not be recompressed")
+	assert.Equal(t, imgspecv1.MediaTypeImageLayerZstd, man.Layers[1].MediaType, "shipped layer should use zstd")
+	zstdMagic := []byte{0x28, 0xb5, 0x2f, 0xfd}
+	assert.True(t, bytes.HasPrefix(readBlob(t, dst, man.Layers[1]), zstdMagic), "shipped layer should be zstd compressed")
+
+	pushed := t.TempDir()
+	pushref, err := alltransports.ParseImageName("oci:" + pushed)
+	require.NoError(t, err, "unable to parse push destination")
+	inc = New(WithPushCompression(compression.Gzip, 9))
+	_, err = inc.pushImage(ctx, srcref, pushref, copy.CopySystemImage)
+	require.NoError(t, err, "unable to push image")
+	dgst, man := readManifest(t, pushed)
+	assert.NotEqual(t, original.Digest, dgst, "recompressed image should have a different digest")
+	gzipMagic := []byte{0x1f, 0x8b}
+	for _, layer := range man.Layers {
+		assert.Equal(t, imgspecv1.MediaTypeImageLayerGzip, layer.MediaType, "pushed layers should use gzip")
+		assert.True(t, bytes.HasPrefix(readBlob(t, pushed, layer), gzipMagic), "pushed layers should be gzip compressed")
+	}
+}
+
+func TestPreserveDigestsConflicts(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	layout := newTestLayout(t, src)
+	layout.tag(t, "", layout.image(t, "amd64", "base"))
+	srcref, err := alltransports.ParseImageName("oci:" + src)
+	require.NoError(t, err, "unable to parse source")
+	dstref, err := alltransports.ParseImageName("oci:" + t.TempDir())
+	require.NoError(t, err, "unable to parse destination")
+	_, priv := rsaKeys(t)
+
+	writer, err := NewWriterFromScratch(ctx, dstref, &types.SystemContext{})
+	require.NoError(t, err, "unable to create writer")
+	inc := New(WithPreserveDigests(), WithArchiveCompression(compression.Zstd, 3))
+	assert.ErrorContains(t, inc.copyImage(ctx, writer, srcref, &types.SystemContext{}), "archive compression")
+	for _, opt := range []Option{WithPushCompression(compression.Gzip, 9), WithLayerDecryption(priv)} {
+		_, err := New(WithPreserveDigests(), opt).pushImage(ctx, srcref, dstref, copy.CopySystemImage)
+		assert.ErrorContains(t, err, "preserving digests")
+	}
+}
@@ -0,0 +1,347 @@
+package imo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	// keys without hash preferences default to ripemd160, it must be linked in
+	// for pgp encryption to work with them.
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// encryptedMediaTypes maps the layer media types supported by ocicrypt to their
+// encrypted counterparts.
+var encryptedMediaTypes = map[string]string{
+	imgspecv1.MediaTypeImageLayer:     imgspecv1.MediaTypeImageLayer + "+encrypted",
+	imgspecv1.MediaTypeImageLayerGzip: imgspecv1.MediaTypeImageLayerGzip + "+encrypted",
+	imgspecv1.MediaTypeImageLayerZstd: imgspecv1.MediaTypeImageLayerZstd + "+encrypted",
+}
+
+// pgpKeyRing parses the provided pgp keys, armored or binary, into a key ring.
+func pgpKeyRing(keys [][]byte) (openpgp.EntityList, error) {
+	var ring openpgp.EntityList
+	for _, key := range keys {
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		if err != nil {
+			if entities, err = openpgp.ReadKeyRing(bytes.NewReader(key)); err != nil {
+				return nil, fmt.Errorf("error parsing pgp key: %w", err)
+			}
+		}
+		ring = append(ring, entities...)
+	}
+	return ring, nil
+}
+
+// writeArchive writes the oci layout stored in dir as a tarball into dst. If
+// archive recipients have been configured the tarball is encrypted for them.
+func (inc *Incremental) writeArchive(dir, dst string) error {
+	if inc.archiveRecipients == nil {
+		return tarball(dir, dst)
+	}
+	ring, err := pgpKeyRing(inc.archiveRecipients)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating tarball: %w", err)
+	}
+	defer fp.Close()
+	hints := &openpgp.FileHints{IsBinary: true}
+	config := &packet.Config{DefaultCompressionAlgo: packet.CompressionNone}
+	enc, err := openpgp.Encrypt(fp, ring, nil, hints, config)
+	if err != nil {
+		return fmt.Errorf("error encrypting tarball: %w", err)
+	}
+	if err := writeTar(dir, enc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("error encrypting tarball: %w", err)
+	}
+	return fp.Close()
+}
+
+// decryptStream returns a reader for the plain text content of the provided
+// archive stream. Archives encrypted as a whole are recognized by their first
+// byte (a pgp packet tag always has the most significant bit set while a tar
+// starts with a file name) and decrypted using the archive decryption keys.
+// Returns whether the stream is encrypted or not.
+func (inc *Incremental) decryptStream(r io.Reader) (io.Reader, bool, error) {
+	buffered := bufio.NewReader(r)
+	first, err := buffered.Peek(1)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading archive: %w", err)
+	}
+	if first[0]&0x80 == 0 {
+		return buffered, false, nil
+	}
+	if inc.archiveKeys == nil {
+		return nil, true, fmt.Errorf("archive is encrypted and no decryption keys were provided")
+	}
+	ring, err := pgpKeyRing(inc.archiveKeys)
+	if err != nil {
+		return nil, true, err
+	}
+	msg, err := openpgp.ReadMessage(buffered, ring, nil, nil)
+	if err != nil {
+		return nil, true, fmt.Errorf("error decrypting archive: %w", err)
+	}
+	return msg.UnverifiedBody, true, nil
+}
+
+// decryptArchive returns the path to the plain text version of the archive pointed
+// by src. If the archive is not encrypted src itself is returned, otherwise it is
+// decrypted into the temporary directory. The returned function removes the
+// decrypted archive and must always be called.
+func (inc *Incremental) decryptArchive(src string) (string, func(), error) {
+	noop := func() {}
+	fp, err := os.Open(src)
+	if err != nil {
+		return "", noop, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer fp.Close()
+	plain, encrypted, err := inc.decryptStream(fp)
+	if err != nil {
+		return "", noop, err
+	} else if !encrypted {
+		return src, noop, nil
+	}
+	tpath := path.Join(inc.tmpdir, fmt.Sprintf("%s.tar", uuid.New().String()))
+	cleanup := func() { os.Remove(tpath) }
+	out, err := os.Create(tpath)
+	if err != nil {
+		return "", noop, fmt.Errorf("error creating decrypted archive: %w", err)
+	}
+	defer out.Close()
+	// the integrity of the message is checked once it has been fully read.
+	if _, err := io.Copy(out, plain); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("error decrypting archive: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		cleanup()
+		return "", noop, fmt.Errorf("error writing decrypted archive: %w", err)
+	}
+	return tpath, cleanup, nil
+}
+
+// layerDecryptConfig returns the ocicrypt configuration used to decrypt layers
+// while pushing. Returns nil if no layer decryption keys have been provided.
+func (inc *Incremental) layerDecryptConfig() (*encconfig.DecryptConfig, error) {
+	if inc.layerKeys == nil {
+		return nil, nil
+	}
+	cc, err := encconfig.DecryptWithPrivKeys(inc.layerKeys, make([][]byte, len(inc.layerKeys)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating decryption config: %w", err)
+	}
+	return cc.DecryptConfig, nil
+}
+
+// layoutEncrypter encrypts the layers stored in an oci layout. Manifests and
+// layers already processed are kept, indexed by their original digests, so
+// content shared among images is encrypted only once.
+type layoutEncrypter struct {
+	dir       string
+	config    *encconfig.EncryptConfig
+	manifests map[digest.Digest]imgspecv1.Descriptor
+	layers    map[digest.Digest]imgspecv1.Descriptor
+}
+
+// encryptLayers encrypts, using ocicrypt, all layers present in the oci layout
+// stored in dir for the provided recipients (public keys in PEM or JWK format).
+// Manifests, manifest lists and the layout index are rewritten to refer to the
+// encrypted layers and the plain text layers are removed. Layers left out of the
+// layout are not touched so the manifests still refer to them by their original
+// digests.
+func encryptLayers(dir string, recipients [][]byte) error {
+	cc, err := encconfig.EncryptWithJwe(recipients)
+	if err != nil {
+		return fmt.Errorf("error creating encryption config: %w", err)
+	}
+	enc := &layoutEncrypter{
+		dir:       dir,
+		config:    cc.EncryptConfig,
+		manifests: map[digest.Digest]imgspecv1.Descriptor{},
+		layers:    map[digest.Digest]imgspecv1.Descriptor{},
+	}
+	ipath := path.Join(dir, imgspecv1.ImageIndexFile)
+	data, err := os.ReadFile(ipath)
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("error parsing index: %w", err)
+	}
+	for i, desc := range index.Manifests {
+		if index.Manifests[i], err = enc.manifest(desc); err != nil {
+			return err
+		}
+	}
+	if data, err = json.Marshal(index); err != nil {
+		return fmt.Errorf("error encoding index: %w", err)
+	}
+	if err := os.WriteFile(ipath, data, 0o644); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	for _, processed := range []map[digest.Digest]imgspecv1.Descriptor{enc.manifests, enc.layers} {
+		for dgst, desc := range processed {
+			if dgst == desc.Digest {
+				continue
+			}
+			if err := os.Remove(enc.blobPath(dgst)); err != nil {
+				return fmt.Errorf("error removing plain text blob %s: %w", dgst, err)
+			}
+		}
+	}
+	return nil
+}
+
+// blobPath returns the path for the blob with the provided digest.
+func (e *layoutEncrypter) blobPath(dgst digest.Digest) string {
+	return path.Join(e.dir, imgspecv1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// manifest encrypts the layers of the manifest (or manifest list) pointed by desc
+// and writes the updated manifest into the layout. Returns the descriptor for the
+// updated manifest.
+func (e *layoutEncrypter) manifest(desc imgspecv1.Descriptor) (imgspecv1.Descriptor, error) {
+	if processed, ok := e.manifests[desc.Digest]; ok {
+		return e.updated(desc, processed), nil
+	}
+	data, err := os.ReadFile(e.blobPath(desc.Digest))
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error reading manifest %s: %w", desc.Digest, err)
+	}
+	var updated any
+	changed := false
+	switch desc.MediaType {
+	case imgspecv1.MediaTypeImageIndex:
+		var index imgspecv1.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return imgspecv1.Descriptor{}, fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for i, child := range index.Manifests {
+			if index.Manifests[i], err = e.manifest(child); err != nil {
+				return imgspecv1.Descriptor{}, err
+			}
+			changed = changed || index.Manifests[i].Digest != child.Digest
+		}
+		updated = index
+	case imgspecv1.MediaTypeImageManifest:
+		var man imgspecv1.Manifest
+		if err := json.Unmarshal(data, &man); err != nil {
+			return imgspecv1.Descriptor{}, fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+		}
+		for i, layer := range man.Layers {
+			if man.Layers[i], err = e.layer(layer); err != nil {
+				return imgspecv1.Descriptor{}, err
+			}
+			changed = changed || man.Layers[i].Digest != layer.Digest
+		}
+		updated = man
+	default:
+		return imgspecv1.Descriptor{}, fmt.Errorf("manifest %s has unsupported type %q", desc.Digest, desc.MediaType)
+	}
+	if !changed {
+		e.manifests[desc.Digest] = desc
+		return desc, nil
+	}
+	if data, err = json.Marshal(updated); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error encoding manifest %s: %w", desc.Digest, err)
+	}
+	dgst := digest.FromBytes(data)
+	if err := os.WriteFile(e.blobPath(dgst), data, 0o644); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing manifest %s: %w", dgst, err)
+	}
+	processed := imgspecv1.Descriptor{MediaType: desc.MediaType, Digest: dgst, Size: int64(len(data))}
+	e.manifests[desc.Digest] = processed
+	return e.updated(desc, processed), nil
+}
+
+// updated returns a copy of desc pointing to the processed blob. Annotations and
+// platform are preserved.
+func (e *layoutEncrypter) updated(desc, processed imgspecv1.Descriptor) imgspecv1.Descriptor {
+	desc.MediaType = processed.MediaType
+	desc.Digest = processed.Digest
+	desc.Size = processed.Size
+	if processed.Annotations != nil {
+		desc.Annotations = processed.Annotations
+	}
+	return desc
+}
+
+// layer encrypts the layer pointed by desc, if present in the layout, and returns
+// the descriptor for the encrypted layer. Returns desc as is for layers not
+// present in the layout.
+func (e *layoutEncrypter) layer(desc imgspecv1.Descriptor) (imgspecv1.Descriptor, error) {
+	if processed, ok := e.layers[desc.Digest]; ok {
+		return e.updated(desc, processed), nil
+	}
+	src, err := os.Open(e.blobPath(desc.Digest))
+	if os.IsNotExist(err) {
+		e.layers[desc.Digest] = desc
+		return desc, nil
+	} else if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error opening layer %s: %w", desc.Digest, err)
+	}
+	defer src.Close()
+	mediaType, ok := encryptedMediaTypes[desc.MediaType]
+	if !ok {
+		return imgspecv1.Descriptor{}, fmt.Errorf("layer %s has unsupported type %q", desc.Digest, desc.MediaType)
+	}
+	encrypted, finalizer, err := ocicrypt.EncryptLayer(e.config, src, desc)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error encrypting layer %s: %w", desc.Digest, err)
+	}
+	tpath := path.Join(e.dir, imgspecv1.ImageBlobsDir, uuid.New().String())
+	dst, err := os.Create(tpath)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error creating encrypted layer: %w", err)
+	}
+	defer os.Remove(tpath)
+	defer dst.Close()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(dst, digester.Hash()), encrypted)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error encrypting layer %s: %w", desc.Digest, err)
+	}
+	if err := dst.Close(); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing encrypted layer: %w", err)
+	}
+	annotations, err := finalizer()
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error finalizing layer %s encryption: %w", desc.Digest, err)
+	}
+	for key, value := range desc.Annotations {
+		if _, ok := annotations[key]; !ok {
+			annotations[key] = value
+		}
+	}
+	processed := imgspecv1.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: annotations,
+	}
+	if err := os.Rename(tpath, e.blobPath(processed.Digest)); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("error writing encrypted layer: %w", err)
+	}
+	e.layers[desc.Digest] = processed
+	return e.updated(desc, processed), nil
+}
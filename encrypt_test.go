@@ -0,0 +1,147 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// rsaKeys returns a new rsa key pair, PEM encoded.
+func rsaKeys(t *testing.T) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "unable to generate key")
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err, "unable to marshal public key")
+	pubpem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	privpem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return pubpem, privpem
+}
+
+// pgpKeys returns a new pgp key pair, serialized in binary format.
+func pgpKeys(t *testing.T) ([]byte, []byte) {
+	entity, err := openpgp.NewEntity("imo", "", "imo@example.com", nil)
+	require.NoError(t, err, "unable to generate pgp key")
+	pub, priv := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	require.NoError(t, entity.Serialize(pub), "unable to serialize public key")
+	require.NoError(t, entity.SerializePrivate(priv, nil), "unable to serialize private key")
+	return pub.Bytes(), priv.Bytes()
+}
+
+// readManifest reads the image manifest pointed by the only entry in the layout index.
+func readManifest(t *testing.T, dir string) (digest.Digest, imgspecv1.Manifest) {
+	data, err := os.ReadFile(filepath.Join(dir, imgspecv1.ImageIndexFile))
+	require.NoError(t, err, "unable to read index")
+	var index imgspecv1.Index
+	require.NoError(t, json.Unmarshal(data, &index), "unable to parse index")
+	require.Len(t, index.Manifests, 1, "unexpected number of images")
+	dgst := index.Manifests[0].Digest
+	data, err = os.ReadFile(filepath.Join(dir, "blobs", "sha256", dgst.Encoded()))
+	require.NoError(t, err, "unable to read manifest")
+	var man imgspecv1.Manifest
+	require.NoError(t, json.Unmarshal(data, &man), "unable to parse manifest")
+	return dgst, man
+}
+
+func TestEncryptLayers(t *testing.T) {
+	pub, priv := rsaKeys(t)
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	original := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", original)
+	base, top := digest.FromString("base"), digest.FromString("top")
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs", "sha256", base.Encoded())))
+
+	err := encryptLayers(dir, [][]byte{pub})
+	require.NoError(t, err, "unable to encrypt layers")
+	_, man := readManifest(t, dir)
+	assert.Equal(t, base, man.Layers[0].Digest, "omitted layer should not change")
+	assert.Equal(t, imgspecv1.MediaTypeImageLayer, man.Layers[0].MediaType)
+	assert.NotEqual(t, top, man.Layers[1].Digest, "shipped layer not encrypted")
+	assert.True(t, strings.HasSuffix(man.Layers[1].MediaType, "+encrypted"))
+	_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", top.Encoded()))
+	assert.True(t, os.IsNotExist(err), "plain text layer not removed")
+
+	md := Metadata{Images: []ImageMetadata{{Final: "app", Omitted: []digest.Digest{base}}}}
+	require.NoError(t, writeMetadata(dir, md))
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(dir, tpath))
+	assert.NoError(t, Verify(tpath), "encrypted archive should verify without keys")
+
+	// decrypting while copying restores the original manifest.
+	layout.blob(t, imgspecv1.MediaTypeImageLayer, []byte("base"))
+	inc := New(WithLayerDecryption(priv))
+	decrypt, err := inc.layerDecryptConfig()
+	require.NoError(t, err, "unable to create decryption config")
+	srcref, err := alltransports.ParseImageName("oci:" + dir)
+	require.NoError(t, err)
+	dst := t.TempDir()
+	dstref, err := alltransports.ParseImageName("oci:" + dst)
+	require.NoError(t, err)
+	polctx, err := policyContext()
+	require.NoError(t, err)
+	_, err = copy.Image(context.Background(), polctx, dstref, srcref, &copy.Options{
+		SourceCtx:        &types.SystemContext{},
+		DestinationCtx:   &types.SystemContext{OCIAcceptUncompressedLayers: true},
+		OciDecryptConfig: decrypt,
+	})
+	require.NoError(t, err, "unable to decrypt image")
+	dgst, _ := readManifest(t, dst)
+	assert.Equal(t, original.Digest, dgst, "original manifest not restored")
+}
+
+func TestArchiveEncryption(t *testing.T) {
+	pub, priv := pgpKeys(t)
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err := New(WithArchiveEncryption(pub)).writeArchive(dir, tpath)
+	require.NoError(t, err, "unable to write encrypted archive")
+	assert.Error(t, Verify(tpath), "encrypted archive should not be readable")
+
+	_, _, err = New().decryptArchive(tpath)
+	assert.Error(t, err, "archive decrypted without keys")
+
+	_, other := pgpKeys(t)
+	_, _, err = New(WithArchiveDecryption(other)).decryptArchive(tpath)
+	assert.Error(t, err, "archive decrypted with the wrong key")
+
+	plain, cleanup, err := New(WithArchiveDecryption(priv)).decryptArchive(tpath)
+	require.NoError(t, err, "unable to decrypt archive")
+	defer cleanup()
+	assert.NoError(t, Verify(plain), "decrypted archive does not verify")
+
+	same, _, err := New().decryptArchive(plain)
+	assert.NoError(t, err, "plain archive should be read as is")
+	assert.Equal(t, plain, same)
+}
+
+func TestLayerEncryptionReferrers(t *testing.T) {
+	pub, _ := rsaKeys(t)
+	inc := New(WithLayerEncryption(pub), WithReferrers())
+	assert.ErrorContains(t, inc.validate(), "referrers", "encryption should be refused with referrers")
+
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	md := Metadata{Images: []ImageMetadata{{Final: "app", Referrers: []Referrer{{}}}}}
+	_, err := New(WithLayerEncryption(pub)).archive(dir, md)
+	assert.ErrorContains(t, err, "referrers", "archives with referrers should not be encrypted")
+}
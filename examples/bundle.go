@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ricardomaraschini/imo"
+)
+
+func bundle() {
+	// Create a new incremental puller setting its output to the standard output.
+	inc := imo.New(
+		imo.WithReporterWriter(os.Stdout),
+	)
+	// Pull the difference for multiple images at once. Layers shared among the
+	// images (e.g. a common base os layer) are stored only once in the bundle.
+	diff, err := inc.PullBundle(
+		context.Background(),
+		[]imo.BundleEntry{
+			{
+				Name:  "app",
+				Base:  "myaccount/app:v1.0.0",
+				Final: "myaccount/app:v2.0.0",
+			},
+			{
+				Name:  "worker",
+				Base:  "myaccount/worker:v1.0.0",
+				Final: "myaccount/worker:v2.0.0",
+			},
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+	// We always need to close the diff reader.
+	defer diff.Close()
+	fp, err := os.Create("bundle.tar")
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+	if _, err := io.Copy(fp, diff); err != nil {
+		panic(err)
+	}
+	// Push each of the images in the bundle to its own destination.
+	results, err := inc.PushBundle(
+		context.Background(),
+		"bundle.tar",
+		map[string]string{
+			"app":    "myregistry.io/myaccount/app:v2.0.0",
+			"worker": "myregistry.io/myaccount/worker:v2.0.0",
+		},
+	)
+	if err != nil {
+		panic(err)
+	}
+	for name, result := range results {
+		fmt.Println(name, "pushed as", result.PinnedReference)
+	}
+}
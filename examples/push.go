@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 
 	"github.com/ricardomaraschini/imo"
@@ -30,11 +31,18 @@ func push() {
 	// any of the layers this will fail. In other words, if we generate a diff
 	// between v1 and v2 on registry A when we try to push to registry B it will
 	// fail if registry B does not have the layers from v1.
-	if err := inc.Push(
+	result, err := inc.Push(
 		context.Background(),
 		"difference.tar",
 		"myaccount/app:v2.0.0",
-	); err != nil {
+	)
+	if err != nil {
 		panic(err)
 	}
+	// The result holds the digest of the pushed manifest (and of its children
+	// for multi-arch images), deployments can pin it right away.
+	fmt.Println("pushed", result.PinnedReference)
+	for _, instance := range result.Instances {
+		fmt.Println(instance.Platform.Architecture, instance.Digest)
+	}
 }
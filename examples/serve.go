@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/ricardomaraschini/imo"
+)
+
+func serve() {
+	// Create a new incremental puller setting its output to the standard output
+	// and providing credentials for reading both images.
+	inc := imo.New(
+		imo.WithReporterWriter(os.Stdout),
+		imo.WithBaseAuth("user", "pass"),
+		imo.WithFinalAuth("user2", "pass2"),
+	)
+	// Create a server computing diffs with the incremental puller. Clients must
+	// provide the token, at most four diffs are computed at the same time and
+	// the last thirty two computed diffs are kept on disk.
+	server, err := imo.NewServer(
+		inc,
+		imo.WithServerTokens("secret"),
+		imo.WithServerConcurrency(4),
+		imo.WithServerCacheSize(32),
+	)
+	if err != nil {
+		panic(err)
+	}
+	// We always need to close the server so the cached diffs are removed.
+	defer server.Close()
+	// Diffs can now be fetched with, for example:
+	// curl -H "Authorization: Bearer secret" -o difference.tar \
+	//   "http://localhost:8080/diff?base=myaccount/myapp:v1.0.0&final=myaccount/myapp:v2.0.0"
+	if err := http.ListenAndServe(":8080", server); err != nil {
+		panic(err)
+	}
+}
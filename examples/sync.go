@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ricardomaraschini/imo"
+)
+
+func sync() {
+	// Create a new incremental syncer setting its output to the standard output
+	// and providing credentials for reading the final image and for pushing it.
+	inc := imo.New(
+		imo.WithReporterWriter(os.Stdout),
+		imo.WithFinalAuth("user", "pass"),
+		imo.WithPushAuth("user2", "pass2"),
+	)
+	// Copy the image straight to the destination registry. Layers of the images
+	// already tagged in the destination repository are not copied. A base image
+	// (e.g. "myaccount/myapp:v1.0.0") can be provided as the last argument to
+	// use it, instead of the destination tags, as reference.
+	result, err := inc.Sync(
+		context.Background(),
+		"myaccount/myapp:v2.0.0",
+		"registry.example.com/myaccount/myapp:v2.0.0",
+	)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("synced", result.PinnedReference)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/ricardomaraschini/imo"
+)
+
+func watch() {
+	// Create a new incremental puller setting its output to the standard output
+	// and providing credentials for reading the watched images. As archives go
+	// from one digest of a tag to another both auths point to the same registry.
+	inc := imo.New(
+		imo.WithReporterWriter(os.Stdout),
+		imo.WithBaseAuth("user", "pass"),
+		imo.WithFinalAuth("user", "pass"),
+	)
+	// Watch a tag and all the tags of a repository. Whenever one of them moves an
+	// archive, going from the previous digest to the new one, is written into the
+	// outbox directory along with a JSON file describing it.
+	watcher, err := imo.NewWatcher(
+		inc,
+		"outbox",
+		[]string{"myaccount/myapp:stable", "myaccount/mytools"},
+		imo.WithWatchTokens("secret"),
+	)
+	if err != nil {
+		panic(err)
+	}
+	// Registries can be configured to notify us on http://<host>:8080/, each
+	// notification triggers an immediate check.
+	go func() {
+		if err := http.ListenAndServe(":8080", watcher); err != nil {
+			panic(err)
+		}
+	}()
+	// Check the references every five minutes, and on notifications, forever.
+	if err := watcher.Run(context.Background()); err != nil {
+		panic(err)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"io"
 	"os"
 	"path"
+	"time"
 
 	"github.com/google/uuid"
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/pkg/compression"
 	"go.podman.io/image/v5/transports/alltransports"
 	"go.podman.io/image/v5/types"
 )
@@ -34,17 +36,52 @@ type Authentications struct {
 // When Pushing the difference to a destination registry it is important to note that
 // the other layers (the ones not included in the 'difference') exist.
 type Incremental struct {
-	tmpdir       string
-	report       io.Writer
-	auths        Authentications
-	selection    copy.ImageListSelection
-	insecurePull types.OptionalBool
-	insecurePush types.OptionalBool
+	tmpdir            string
+	report            io.Writer
+	auths             Authentications
+	selection         copy.ImageListSelection
+	insecurePull      types.OptionalBool
+	insecurePush      types.OptionalBool
+	parallel          uint
+	retry             RetryPolicy
+	pullLimiter       *RateLimiter
+	pushLimiter       *RateLimiter
+	pullFormat        *compression.Algorithm
+	pullLevel         *int
+	pushFormat        *compression.Algorithm
+	pushLevel         *int
+	preserveDigests   bool
+	archiveRecipients [][]byte
+	archiveKeys       [][]byte
+	layerRecipients   [][]byte
+	layerKeys         [][]byte
+	signingKey        []byte
+	signingPass       []byte
+	trustedKeys       [][]byte
+	referrers         bool
+	cache             Cache
+	rateLimit         RateLimitPolicy
+	budgets           *budgets
+	clock             clock
+	syncTags          []string
 }
 
 // PushVet verifies if all the layers not included in the incremental difference exist
-// in the destination registry. If not, it returns an error.
+// in the destination registry. If not, it returns an error. Archives encrypted as a
+// whole need the decryption keys (see WithArchiveDecryption) while archives with
+// encrypted layers can be vetted without them. If trusted keys have been provided
+// (see WithTrustedKeys) the archive signature is verified first.
 func (inc *Incremental) PushVet(ctx context.Context, src, dst string) error {
+	src, cleanup, err := inc.decryptArchive(src)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if inc.trustedKeys != nil {
+		if err := inc.verifyArchive(src); err != nil {
+			return fmt.Errorf("error verifying archive: %w", err)
+		}
+	}
 	dst = fmt.Sprintf("docker://%s", dst)
 	dstref, err := alltransports.ParseImageName(dst)
 	if err != nil {
@@ -55,7 +92,9 @@ func (inc *Incremental) PushVet(ctx context.Context, src, dst string) error {
 		DockerInsecureSkipTLSVerify: inc.insecurePush,
 	}
 	dstman := NewManifestsIndex(sysctx)
-	if err := dstman.FetchManifests(ctx, dstref); err != nil {
+	if err := inc.withRetry(ctx, func() error {
+		return dstman.FetchManifests(ctx, inc.cached(inc.budgeted(dstref)))
+	}); err != nil {
 		return fmt.Errorf("error fetching destination manifests: %w", err)
 	}
 	srcref, err := alltransports.ParseImageName(fmt.Sprintf("oci-archive:%s", src))
@@ -89,103 +128,359 @@ func (inc *Incremental) PushVet(ctx context.Context, src, dst string) error {
 }
 
 // Push pushes the incremental difference stored in the oci-archive tarball pointed by
-// src to the destination registry pointed by to. Be aware that if the remote registry
+// src to the destination registry pointed by to. The archive is verified (see Verify)
+// before anything is sent to the registry. Be aware that if the remote registry
 // does not contain one or more of the layers not included in the incremental difference
-// the push will fail.
-func (inc *Incremental) Push(ctx context.Context, src, dst string) error {
-	dst = fmt.Sprintf("docker://%s", dst)
-	dstref, err := alltransports.ParseImageName(dst)
+// the push will fail. The image can also be pushed to multiple aliases (other tags or
+// repositories), the archive is read and its blobs are uploaded only once. Aliases
+// are created from the image pushed to dst, using cross repository blob mounts when
+// the registry supports them. Encrypted archives are decrypted with the keys set by
+// WithArchiveDecryption and WithLayerDecryption. If trusted keys have been provided
+// (see WithTrustedKeys) unsigned or mis-signed archives are refused. Referrers stored
+// in the archive are re-attached to dst if WithReferrers is set.
+func (inc *Incremental) Push(ctx context.Context, src, dst string, aliases ...string) (*PushResult, error) {
+	src, cleanup, err := inc.decryptArchive(src)
 	if err != nil {
-		return fmt.Errorf("error parsing destination reference: %w", err)
+		return nil, err
+	}
+	defer cleanup()
+	content, err := inc.readVerified(src)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying archive: %w", err)
+	}
+	selection, err := inc.archiveSelection(content)
+	if err != nil {
+		return nil, err
 	}
 	srcref, err := alltransports.ParseImageName(fmt.Sprintf("oci-archive:%s", src))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing source reference: %w", err)
+	}
+	result, err := inc.pushFrom(ctx, srcref, dst, selection)
+	if err != nil {
+		return nil, err
+	}
+	if inc.referrers && content.metadata != nil {
+		for _, img := range content.metadata.Images {
+			if err := inc.pushReferrers(ctx, srcref, dst, img.Referrers); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, alias := range aliases {
+		if err := inc.pushAlias(ctx, result, alias); err != nil {
+			return nil, fmt.Errorf("error pushing alias %s: %w", alias, err)
+		}
+	}
+	return result, nil
+}
+
+// pushAlias copies the image previously pushed, as described by the provided
+// result, to the alias reference. The manifest is copied as is, so the alias
+// has the same digest as the original image. The alias is added to the result.
+func (inc *Incremental) pushAlias(ctx context.Context, result *PushResult, alias string) error {
+	srcref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", result.PinnedReference))
 	if err != nil {
 		return fmt.Errorf("error parsing source reference: %w", err)
 	}
+	dstref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", alias))
+	if err != nil {
+		return fmt.Errorf("error parsing alias reference: %w", err)
+	}
 	polctx, err := policyContext()
 	if err != nil {
 		return fmt.Errorf("error creating policy context: %w", err)
 	}
-	if _, err := copy.Image(
-		ctx,
-		polctx,
-		dstref,
-		srcref,
-		&copy.Options{
-			ReportWriter:       inc.report,
-			SourceCtx:          &types.SystemContext{},
-			ImageListSelection: inc.selection,
-			DestinationCtx: &types.SystemContext{
-				DockerAuthConfig:            inc.auths.PushAuth,
-				DockerInsecureSkipTLSVerify: inc.insecurePush,
+	sysctx := &types.SystemContext{
+		DockerAuthConfig:            inc.auths.PushAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePush,
+		BlobInfoCacheDir:            inc.blobInfoCacheDir(),
+	}
+	if err := inc.withRetry(ctx, func() error {
+		_, err := copy.Image(
+			ctx,
+			polctx,
+			throttle(inc.budgeted(dstref), inc.pushLimiter),
+			inc.budgeted(srcref),
+			&copy.Options{
+				ReportWriter:         inc.report,
+				SourceCtx:            sysctx,
+				DestinationCtx:       sysctx,
+				ImageListSelection:   copy.CopyAllImages,
+				MaxParallelDownloads: inc.parallel,
+				PreserveDigests:      true,
 			},
-		},
-	); err != nil {
+		)
+		return err
+	}); err != nil {
 		return fmt.Errorf("failed copying layers: %w", err)
 	}
+	result.Aliases = append(result.Aliases, dstref.DockerReference().String())
 	return nil
 }
 
-// Pull pulls the incremental difference between two images. Returns an ReaderCloser from
-// where can be read as an oci-archive tarball. The caller is responsible for closing the
-// reader. If 'base' is equal to 'scratch' then we do not compare the layers of the final
-// image with the layers of the base image. In this case, the returned tarball contains
-// all the layers of the final image.
-func (inc *Incremental) Pull(ctx context.Context, base, final string) (io.ReadCloser, error) {
-	base = fmt.Sprintf("docker://%s", base)
-	baseref, err := alltransports.ParseImageName(base)
+// pushFrom copies the image pointed by srcref to the destination registry pointed
+// by dst, using the provided image list selection.
+func (inc *Incremental) pushFrom(ctx context.Context, srcref types.ImageReference, dst string, selection copy.ImageListSelection) (*PushResult, error) {
+	dst = fmt.Sprintf("docker://%s", dst)
+	dstref, err := alltransports.ParseImageName(dst)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	rawman, err := inc.pushImage(ctx, srcref, dstref, selection)
+	if err != nil {
+		return nil, err
+	}
+	return newPushResult(dstref, rawman)
+}
+
+// pushImage copies the image pointed by srcref to dstref, using the provided image
+// list selection and the push options (e.g. compression and decryption). Returns
+// the manifest written to the destination.
+func (inc *Incremental) pushImage(ctx context.Context, srcref, dstref types.ImageReference, selection copy.ImageListSelection) ([]byte, error) {
+	if err := inc.validate(); err != nil {
+		return nil, err
+	}
+	polctx, err := policyContext()
 	if err != nil {
-		return nil, fmt.Errorf("error parsing base reference: %w", err)
+		return nil, fmt.Errorf("error creating policy context: %w", err)
 	}
-	final = fmt.Sprintf("docker://%s", final)
-	finalref, err := alltransports.ParseImageName(final)
+	decrypt, err := inc.layerDecryptConfig()
 	if err != nil {
-		return nil, fmt.Errorf("error parsing final reference: %w", err)
+		return nil, err
 	}
-	fname := fmt.Sprintf("%s.tar", uuid.New().String())
-	tpath := path.Join(inc.tmpdir, fname)
-	dstref, err := alltransports.ParseImageName(fmt.Sprintf("oci-archive:%s", tpath))
+	var rawman []byte
+	if err := inc.withRetry(ctx, func() error {
+		rawman, err = copy.Image(
+			ctx,
+			polctx,
+			throttle(inc.budgeted(dstref), inc.pushLimiter),
+			srcref,
+			&copy.Options{
+				ReportWriter:         inc.report,
+				SourceCtx:            &types.SystemContext{},
+				ImageListSelection:   selection,
+				MaxParallelDownloads: inc.parallel,
+				PreserveDigests:      inc.preserveDigests,
+				OciDecryptConfig:     decrypt,
+				DestinationCtx: &types.SystemContext{
+					DockerAuthConfig:            inc.auths.PushAuth,
+					DockerInsecureSkipTLSVerify: inc.insecurePush,
+					CompressionFormat:           inc.pushFormat,
+					CompressionLevel:            inc.pushLevel,
+					BlobInfoCacheDir:            inc.blobInfoCacheDir(),
+				},
+			},
+		)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed copying layers: %w", err)
+	}
+	return rawman, nil
+}
+
+// Pull pulls the incremental difference between two images. Returns a Diff from where
+// can be read as an oci-archive tarball. The caller is responsible for closing the Diff.
+// If 'base' is equal to 'scratch' then we do not compare the layers of the final image
+// with the layers of the base image. In this case, the returned tarball contains all
+// the layers of the final image. Both base and final can be referred by tag or by
+// digest, tags are resolved to digests before anything else so the difference is
+// calculated between the same images during the whole operation. The references,
+// pinned by digest, are recorded in the Diff metadata.
+func (inc *Incremental) Pull(ctx context.Context, base, final string) (*Diff, error) {
+	dir := path.Join(inc.tmpdir, uuid.New().String())
+	defer os.RemoveAll(dir)
+	dstref, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s", dir))
 	if err != nil {
 		return nil, fmt.Errorf("error parsing destination reference: %w", err)
 	}
+	md, index, err := inc.pullInto(ctx, dstref, base, final)
+	if err != nil {
+		return nil, err
+	}
+	if inc.referrers {
+		if err := inc.pullReferrers(ctx, dir, index, &md); err != nil {
+			return nil, err
+		}
+	}
+	return inc.archive(dir, Metadata{Images: []ImageMetadata{md}})
+}
+
+// pullInto copies the incremental difference between base and final into the
+// provided destination reference. If 'base' is equal to 'scratch' all layers
+// of the final image are copied. The whole operation is retried according to
+// the retry policy, blobs copied by previous attempts are reused. Returns the
+// metadata describing the copied image and the index of the base image layers.
+func (inc *Incremental) pullInto(ctx context.Context, dstref types.ImageReference, base, final string) (ImageMetadata, LayerIndex, error) {
 	sysctx := &types.SystemContext{DockerAuthConfig: inc.auths.BaseAuth}
-	var destref *Writer
-	if base == "docker://scratch" {
-		if destref, err = NewWriterFromScratch(ctx, dstref, sysctx); err != nil {
-			return nil, fmt.Errorf("error creating incremental writer: %w", err)
+	md := ImageMetadata{Base: "scratch"}
+	var baseref types.ImageReference
+	if base != "scratch" {
+		var err error
+		if baseref, err = inc.pin(ctx, sysctx, base); err != nil {
+			return md, nil, fmt.Errorf("error pinning base reference: %w", err)
+		}
+		md.Base = baseref.DockerReference().String()
+	}
+	finalref, err := inc.pin(ctx, inc.finalSysctx(), final)
+	if err != nil {
+		return md, nil, fmt.Errorf("error pinning final reference: %w", err)
+	}
+	md.Final = finalref.DockerReference().String()
+	index := NewManifestsIndex(sysctx)
+	err = inc.withRetry(ctx, func() error {
+		if baseref != nil {
+			if err := index.FetchManifests(ctx, baseref); err != nil {
+				return fmt.Errorf("error fetching base manifests: %w", err)
+			}
+		}
+		destref, err := NewWriterFromIndex(ctx, index, dstref, sysctx)
+		if err != nil {
+			return fmt.Errorf("error creating incremental writer: %w", err)
+		}
+		if err := inc.copyImage(ctx, destref, finalref, inc.finalSysctx()); err != nil {
+			return err
+		}
+		md.Omitted = destref.Omitted()
+		return nil
+	})
+	return md, index, err
+}
+
+// pullFromIndex pulls the image pointed by srcref, accessed using the provided
+// system context, into a new archive. Layers present in the index are omitted
+// and recorded in the provided metadata.
+func (inc *Incremental) pullFromIndex(ctx context.Context, index LayerIndex, srcref types.ImageReference, srcctx *types.SystemContext, md ImageMetadata) (*Diff, error) {
+	dir := path.Join(inc.tmpdir, uuid.New().String())
+	defer os.RemoveAll(dir)
+	dstref, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s", dir))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	if err := inc.withRetry(ctx, func() error {
+		destref, err := NewWriterFromIndex(ctx, index, dstref, &types.SystemContext{})
+		if err != nil {
+			return fmt.Errorf("error creating incremental writer: %w", err)
+		}
+		if err := inc.copyImage(ctx, destref, srcref, srcctx); err != nil {
+			return err
 		}
-	} else {
-		if destref, err = NewWriter(ctx, baseref, dstref, sysctx); err != nil {
-			return nil, fmt.Errorf("error creating incremental writer: %w", err)
+		md.Omitted = destref.Omitted()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if inc.referrers {
+		if err := inc.pullReferrers(ctx, dir, index, &md); err != nil {
+			return nil, err
 		}
 	}
+	return inc.archive(dir, Metadata{Images: []ImageMetadata{md}})
+}
+
+// finalSysctx returns the system context used to access the final image.
+func (inc *Incremental) finalSysctx() *types.SystemContext {
+	return &types.SystemContext{
+		DockerAuthConfig:            inc.auths.FinalAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePull,
+	}
+}
+
+// copyImage copies the image pointed by srcref, accessed using the provided system
+// context, into the provided incremental writer. Layers the writer considers
+// present on the other side are not copied. Besides container images, OCI artifacts
+// (e.g. Helm charts or WASM modules) are copied as they are, see selectionFor.
+func (inc *Incremental) copyImage(ctx context.Context, destref *Writer, srcref types.ImageReference, srcctx *types.SystemContext) error {
+	if err := inc.validate(); err != nil {
+		return err
+	}
 	polctx, err := policyContext()
 	if err != nil {
-		return nil, fmt.Errorf("error creating policy context: %w", err)
+		return fmt.Errorf("error creating policy context: %w", err)
+	}
+	selection, err := inc.sourceSelection(ctx, srcref, srcctx)
+	if err != nil {
+		return err
 	}
 	if _, err := copy.Image(
 		ctx,
 		polctx,
 		destref,
-		finalref,
+		throttle(srcref, inc.pullLimiter),
 		&copy.Options{
-			ReportWriter:       inc.report,
-			DestinationCtx:     &types.SystemContext{},
-			ImageListSelection: inc.selection,
-			SourceCtx: &types.SystemContext{
-				DockerAuthConfig:            inc.auths.FinalAuth,
-				DockerInsecureSkipTLSVerify: inc.insecurePull,
+			ReportWriter:         inc.report,
+			ImageListSelection:   selection,
+			MaxParallelDownloads: inc.parallel,
+			PreserveDigests:      inc.preserveDigests,
+			SourceCtx:            srcctx,
+			DestinationCtx: &types.SystemContext{
+				CompressionFormat: inc.pullFormat,
+				CompressionLevel:  inc.pullLevel,
+				BlobInfoCacheDir:  inc.blobInfoCacheDir(),
 			},
 		},
 	); err != nil {
-		return nil, fmt.Errorf("failed copying layers: %w", err)
+		return fmt.Errorf("failed copying layers: %w", err)
+	}
+	return nil
+}
+
+// archive writes the metadata into the oci layout stored in dir and turns it into
+// an oci-archive tarball. Returns a Diff for the tarball, the tarball is removed
+// from disk once the Diff is closed. Archives holding referrers can't have their
+// layers encrypted as the referrers would point to the original manifests.
+func (inc *Incremental) archive(dir string, md Metadata) (*Diff, error) {
+	if inc.layerRecipients != nil {
+		for _, img := range md.Images {
+			if len(img.Referrers) > 0 {
+				return nil, fmt.Errorf("layer encryption can't be used on archives with referrers")
+			}
+		}
+		if err := encryptLayers(dir, inc.layerRecipients); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeMetadata(dir, md); err != nil {
+		return nil, err
+	}
+	if inc.signingKey != nil {
+		if err := inc.signLayout(dir); err != nil {
+			return nil, err
+		}
+	}
+	tpath := path.Join(inc.tmpdir, fmt.Sprintf("%s.tar", uuid.New().String()))
+	if err := inc.writeArchive(dir, tpath); err != nil {
+		os.Remove(tpath)
+		return nil, fmt.Errorf("error creating tarball: %w", err)
 	}
 	fp, err := os.Open(tpath)
 	if err != nil {
 		os.Remove(tpath)
 		return nil, fmt.Errorf("error opening tarball: %w", err)
 	}
-	return RemoveOnClose{fp, tpath}, nil
+	return &Diff{ReadCloser: RemoveOnClose{fp, tpath}, Metadata: md}, nil
+}
+
+// validate returns an error if options that can't be used together have been set.
+// Manifests can't be preserved while layers are recompressed or decrypted and
+// layers can't be encrypted while referrers, pointing to the original manifests,
+// are included.
+func (inc *Incremental) validate() error {
+	if inc.referrers && inc.layerRecipients != nil {
+		return fmt.Errorf("layer encryption can't be used together with referrers")
+	}
+	if !inc.preserveDigests {
+		return nil
+	}
+	switch {
+	case inc.pullFormat != nil:
+		return fmt.Errorf("archive compression can't be used while preserving digests")
+	case inc.pushFormat != nil:
+		return fmt.Errorf("push compression can't be used while preserving digests")
+	case inc.layerKeys != nil:
+		return fmt.Errorf("layer decryption can't be used while preserving digests")
+	}
+	return nil
 }
 
 // New returns a new Incremental object. With Incremental objects callers can calculate
@@ -198,6 +493,13 @@ func New(opts ...Option) *Incremental {
 		selection:    copy.CopySystemImage,
 		insecurePull: types.OptionalBoolFalse,
 		insecurePush: types.OptionalBoolFalse,
+		retry:        RetryPolicy{Attempts: 1},
+		clock:        systemClock{},
+		rateLimit: RateLimitPolicy{
+			Attempts:   4,
+			Backoff:    30 * time.Second,
+			MaxBackoff: 5 * time.Minute,
+		},
 	}
 	for _, opt := range opts {
 		opt(inc)
@@ -51,6 +51,8 @@ func TestIncrementalPullAlpine(t *testing.T) {
 	diff, err := inc.Pull(ctx, "scratch", "docker.io/alpine:latest")
 	require.NoError(t, err, "unable to pull the whole image")
 	defer diff.Close()
+	require.Len(t, diff.Metadata.Images, 1, "metadata not recorded")
+	assert.Contains(t, diff.Metadata.Images[0].Final, "@sha256:", "final not pinned")
 	_, err = io.Copy(tmpf, diff)
 	assert.NoError(t, err, "unable to copy image to temp file")
 	err = tmpf.Close()
@@ -98,7 +100,7 @@ func TestIncrementalE2E(t *testing.T) {
 	// pushes the pulled tomcat:10.1 to the registry under the
 	// tag specified in the environment variable.
 	dst := fmt.Sprintf("%s/e2e:%s", addr, tag)
-	err = inc.Push(ctx, tmpf.Name(), dst)
+	_, err = inc.Push(ctx, tmpf.Name(), dst)
 	assert.NoError(t, err, "unable to push whole image")
 
 	// pulls the difference between tomcat:10.1 and tomcat:11.0.
@@ -120,7 +122,11 @@ func TestIncrementalE2E(t *testing.T) {
 	err = inc.PushVet(ctx, tmpf.Name(), dst)
 	assert.NoError(t, err, "unable to push vet image")
 
-	// pushes the difference between tomcat:10.1 and tomcat:11.0.
-	err = inc.Push(ctx, tmpf.Name(), dst)
+	// pushes the difference between tomcat:10.1 and tomcat:11.0, also
+	// tagging it under an alias.
+	alias := fmt.Sprintf("%s/e2e:%s-latest", addr, tag)
+	res, err := inc.Push(ctx, tmpf.Name(), dst, alias)
 	assert.NoError(t, err, "unable to push difference")
+	assert.NotEmpty(t, res.Digest, "push did not return a digest")
+	assert.Len(t, res.Aliases, 1, "alias not pushed")
 }
@@ -0,0 +1,180 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/types"
+)
+
+// InventoryImage describes an image present in a registry. Digest is the digest
+// of the top level manifest (the manifest list for images with multiple arches)
+// and Layers holds the digests of all layers referred by the image.
+type InventoryImage struct {
+	Repository string          `json:"repository"`
+	Tag        string          `json:"tag,omitempty"`
+	Digest     digest.Digest   `json:"digest"`
+	Layers     []digest.Digest `json:"layers"`
+}
+
+// Inventory is a list of images, and their layers, present in a registry. An
+// Inventory can be generated on the disconnected side, saved to disk and then
+// carried to the connected side where it can be used as base for Pull.
+type Inventory struct {
+	mtx    sync.Mutex
+	index  map[digest.Digest]bool
+	Images []InventoryImage `json:"images"`
+}
+
+// HasLayer returns true if the layer is referred by any of the images in the
+// inventory.
+func (inv *Inventory) HasLayer(dgst digest.Digest) bool {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	if inv.index == nil {
+		inv.index = map[digest.Digest]bool{}
+		for _, img := range inv.Images {
+			for _, layer := range img.Layers {
+				inv.index[layer] = true
+			}
+		}
+	}
+	return inv.index[dgst]
+}
+
+// Add adds an image to the inventory.
+func (inv *Inventory) Add(img InventoryImage) {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	inv.Images = append(inv.Images, img)
+	inv.index = nil
+}
+
+// Save writes the inventory, in JSON format, into the provided file.
+func (inv *Inventory) Save(fpath string) error {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding inventory: %w", err)
+	}
+	if err := os.WriteFile(fpath, data, 0o644); err != nil {
+		return fmt.Errorf("error writing inventory: %w", err)
+	}
+	return nil
+}
+
+// LoadInventory reads an inventory previously written by Inventory.Save.
+func LoadInventory(fpath string) (*Inventory, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inventory: %w", err)
+	}
+	var inv Inventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("error decoding inventory: %w", err)
+	}
+	return &inv, nil
+}
+
+// Inventory scans the provided references in the destination registry (the one
+// we push to) and returns an Inventory of the images found there. References
+// without a tag (repositories) have all their tags scanned.
+func (inc *Incremental) Inventory(ctx context.Context, refs ...string) (*Inventory, error) {
+	sysctx := &types.SystemContext{
+		DockerAuthConfig:            inc.auths.PushAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePush,
+	}
+	inv := &Inventory{}
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing reference %s: %w", ref, err)
+		}
+		if !reference.IsNameOnly(named) {
+			if err := inc.inventoryImage(ctx, inv, sysctx, named); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		repo, err := docker.NewReference(reference.TagNameOnly(named))
+		if err != nil {
+			return nil, fmt.Errorf("error creating reference for %s: %w", ref, err)
+		}
+		var tags []string
+		if err := inc.withRetry(ctx, func() error {
+			if err := inc.spend(ctx, reference.Domain(named)); err != nil {
+				return err
+			}
+			tags, err = docker.GetRepositoryTags(ctx, sysctx, repo)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("error listing tags for %s: %w", ref, err)
+		}
+		for _, tag := range tags {
+			tagged, err := reference.WithTag(named, tag)
+			if err != nil {
+				return nil, fmt.Errorf("error tagging %s with %s: %w", ref, tag, err)
+			}
+			if err := inc.inventoryImage(ctx, inv, sysctx, tagged); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return inv, nil
+}
+
+// inventoryImage fetches the manifests for the provided image and adds it to
+// the inventory.
+func (inc *Incremental) inventoryImage(ctx context.Context, inv *Inventory, sysctx *types.SystemContext, named reference.Named) error {
+	imgref, err := docker.NewReference(named)
+	if err != nil {
+		return fmt.Errorf("error creating reference for %s: %w", named, err)
+	}
+	index := NewManifestsIndex(sysctx)
+	if err := inc.withRetry(ctx, func() error {
+		return index.FetchManifests(ctx, inc.cached(inc.budgeted(imgref)))
+	}); err != nil {
+		return fmt.Errorf("error fetching manifests for %s: %w", named, err)
+	}
+	img := InventoryImage{
+		Repository: named.Name(),
+		Digest:     index.Digest(),
+		Layers:     []digest.Digest{},
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		img.Tag = tagged.Tag()
+	}
+	seen := map[digest.Digest]bool{}
+	for _, man := range index.Manifests() {
+		for _, layer := range man.LayerInfos() {
+			if seen[layer.Digest] {
+				continue
+			}
+			seen[layer.Digest] = true
+			img.Layers = append(img.Layers, layer.Digest)
+		}
+	}
+	inv.Add(img)
+	return nil
+}
+
+// PullFromInventory pulls the incremental difference between the images in the
+// inventory and the final image. All layers present in the inventory are left
+// out of the returned oci-archive tarball. This allows the difference to be
+// calculated without access to the registry holding the base images. The caller
+// is responsible for closing the returned Diff.
+func (inc *Incremental) PullFromInventory(ctx context.Context, inv *Inventory, final string) (*Diff, error) {
+	finalref, err := inc.pin(ctx, inc.finalSysctx(), final)
+	if err != nil {
+		return nil, fmt.Errorf("error pinning final reference: %w", err)
+	}
+	md := ImageMetadata{Final: finalref.DockerReference().String()}
+	return inc.pullFromIndex(ctx, inv, finalref, inc.finalSysctx(), md)
+}
@@ -0,0 +1,31 @@
+package imo
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventorySaveLoad(t *testing.T) {
+	layer := digest.FromString("layer")
+	inv := &Inventory{}
+	inv.Add(InventoryImage{
+		Repository: "registry.internal/myorg/app",
+		Tag:        "v1.0.0",
+		Digest:     digest.FromString("manifest"),
+		Layers:     []digest.Digest{layer},
+	})
+	assert.True(t, inv.HasLayer(layer), "layer should be in the inventory")
+	assert.False(t, inv.HasLayer(digest.FromString("other")), "layer should not be in the inventory")
+
+	fpath := filepath.Join(t.TempDir(), "inventory.json")
+	err := inv.Save(fpath)
+	require.NoError(t, err, "unable to save inventory")
+	loaded, err := LoadInventory(fpath)
+	require.NoError(t, err, "unable to load inventory")
+	assert.Equal(t, inv.Images, loaded.Images)
+	assert.True(t, loaded.HasLayer(layer), "layer should be in the loaded inventory")
+}
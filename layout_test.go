@@ -0,0 +1,102 @@
+package imo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testLayout helps writing oci layouts to disk so tests can run without access
+// to a registry.
+type testLayout struct {
+	dir   string
+	index imgspecv1.Index
+}
+
+// newTestLayout creates an empty oci layout in the provided directory.
+func newTestLayout(t *testing.T, dir string) *testLayout {
+	err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755)
+	require.NoError(t, err, "unable to create blobs directory")
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	err = os.WriteFile(filepath.Join(dir, imgspecv1.ImageLayoutFile), layout, 0o644)
+	require.NoError(t, err, "unable to write oci-layout file")
+	return &testLayout{
+		dir: dir,
+		index: imgspecv1.Index{
+			Versioned: imgspecs.Versioned{SchemaVersion: 2},
+			MediaType: imgspecv1.MediaTypeImageIndex,
+			Manifests: []imgspecv1.Descriptor{},
+		},
+	}
+}
+
+// blob writes a blob into the layout and returns its descriptor.
+func (l *testLayout) blob(t *testing.T, mediaType string, data []byte) imgspecv1.Descriptor {
+	dgst := digest.FromBytes(data)
+	fpath := filepath.Join(l.dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+	err := os.WriteFile(fpath, data, 0o644)
+	require.NoError(t, err, "unable to write blob")
+	return imgspecv1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// json marshals the provided object and writes it as a blob into the layout.
+func (l *testLayout) json(t *testing.T, mediaType string, obj any) imgspecv1.Descriptor {
+	data, err := json.Marshal(obj)
+	require.NoError(t, err, "unable to marshal object")
+	return l.blob(t, mediaType, data)
+}
+
+// image writes an image with the provided layers contents into the layout and
+// returns the descriptor for its manifest.
+func (l *testLayout) image(t *testing.T, arch string, layers ...string) imgspecv1.Descriptor {
+	config := imgspecv1.Image{
+		Platform: imgspecv1.Platform{Architecture: arch, OS: "linux"},
+		RootFS:   imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{}},
+	}
+	descs := []imgspecv1.Descriptor{}
+	for _, layer := range layers {
+		desc := l.blob(t, imgspecv1.MediaTypeImageLayer, []byte(layer))
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, desc.Digest)
+		descs = append(descs, desc)
+	}
+	man := imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    l.json(t, imgspecv1.MediaTypeImageConfig, config),
+		Layers:    descs,
+	}
+	desc := l.json(t, imgspecv1.MediaTypeImageManifest, man)
+	desc.Platform = &imgspecv1.Platform{Architecture: arch, OS: "linux"}
+	return desc
+}
+
+// list writes a manifest list (image index) referring to the provided manifests
+// and returns its descriptor.
+func (l *testLayout) list(t *testing.T, manifests ...imgspecv1.Descriptor) imgspecv1.Descriptor {
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: manifests,
+	}
+	return l.json(t, imgspecv1.MediaTypeImageIndex, index)
+}
+
+// tag adds the descriptor to the layout index.json under the provided name. If
+// name is empty the descriptor is added without a name.
+func (l *testLayout) tag(t *testing.T, name string, desc imgspecv1.Descriptor) {
+	desc.Platform = nil
+	if name != "" {
+		desc.Annotations = map[string]string{imgspecv1.AnnotationRefName: name}
+	}
+	l.index.Manifests = append(l.index.Manifests, desc)
+	data, err := json.Marshal(l.index)
+	require.NoError(t, err, "unable to marshal index")
+	err = os.WriteFile(filepath.Join(l.dir, imgspecv1.ImageIndexFile), data, 0o644)
+	require.NoError(t, err, "unable to write index")
+}
@@ -8,14 +8,20 @@ import (
 	"github.com/opencontainers/go-digest"
 	"go.podman.io/image/v5/manifest"
 	"go.podman.io/image/v5/types"
+	"golang.org/x/sync/errgroup"
 )
 
+// maxParallelFetches is the maximum number of children manifests fetched at the
+// same time when indexing a manifest list.
+const maxParallelFetches = 8
+
 // ManifestsIndex is an entity that indexes multiple manifests that are part
 // of the same image. Provide tooling around the manifests.
 type ManifestsIndex struct {
 	mtx       sync.RWMutex
 	index     map[digest.Digest]bool
 	sysctx    *types.SystemContext
+	digest    digest.Digest
 	manifests []manifest.Manifest
 }
 
@@ -37,6 +43,14 @@ func (m *ManifestsIndex) Manifests() []manifest.Manifest {
 	return result
 }
 
+// Digest returns the digest of the top level manifest of the image. For images with
+// multiple architectures this is the digest of the manifest list.
+func (m *ManifestsIndex) Digest() digest.Digest {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.digest
+}
+
 // FetchManifests gets the manifests from the source image and indexes all the
 // layers that are present in the manifests in the internal 'index' map. Users
 // can then call 'HasLayer' to check if a layer is present in the source image.
@@ -52,6 +66,9 @@ func (m *ManifestsIndex) FetchManifests(ctx context.Context, from types.ImageRef
 	if err != nil {
 		return fmt.Errorf("error getting manifest: %w", err)
 	}
+	if m.digest, err = manifest.Digest(raw); err != nil {
+		return fmt.Errorf("error calculating manifest digest: %w", err)
+	}
 	if manifest.MIMETypeIsMultiImage(mime) {
 		return m.fetchFromList(ctx, fromref, raw, mime)
 	}
@@ -85,23 +102,34 @@ func (m *ManifestsIndex) buildIndex() {
 	}
 }
 
-// fetchFromList is used to parse children manifests of a manifest list.
+// fetchFromList is used to parse children manifests of a manifest list. Children
+// are fetched concurrently, at most maxParallelFetches at a time, but they are
+// kept in the same order they appear in the list.
 func (m *ManifestsIndex) fetchFromList(ctx context.Context, fromref types.ImageSource, raw []byte, mime string) error {
 	list, err := manifest.ListFromBlob(raw, mime)
 	if err != nil {
 		return fmt.Errorf("error parsing manifests: %w", err)
 	}
-	children := []manifest.Manifest{}
-	for _, digest := range list.Instances() {
-		raw, mime, err := fromref.GetManifest(ctx, &digest)
-		if err != nil {
-			return fmt.Errorf("error getting child manifest: %w", err)
-		}
-		man, err := manifest.FromBlob(raw, mime)
-		if err != nil {
-			return fmt.Errorf("error parsing manifest: %w", err)
-		}
-		children = append(children, man)
+	instances := list.Instances()
+	children := make([]manifest.Manifest, len(instances))
+	group, gctx := errgroup.WithContext(ctx)
+	group.SetLimit(maxParallelFetches)
+	for i, digest := range instances {
+		group.Go(func() error {
+			raw, mime, err := fromref.GetManifest(gctx, &digest)
+			if err != nil {
+				return fmt.Errorf("error getting child manifest: %w", err)
+			}
+			man, err := manifest.FromBlob(raw, mime)
+			if err != nil {
+				return fmt.Errorf("error parsing manifest: %w", err)
+			}
+			children[i] = man
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
 	}
 	m.manifests = children
 	m.buildIndex()
@@ -0,0 +1,44 @@
+package imo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestManifestsIndexFetchFromList(t *testing.T) {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	archs := []string{"amd64", "arm64", "ppc64le", "s390x", "386", "arm", "riscv64", "mips64le", "loong64", "wasm"}
+	descs := []imgspecv1.Descriptor{}
+	for _, arch := range archs {
+		descs = append(descs, layout.image(t, arch, "base", fmt.Sprintf("layer-%s", arch)))
+	}
+	list := layout.list(t, descs...)
+	layout.tag(t, "", list)
+
+	ref, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s", dir))
+	require.NoError(t, err, "unable to parse layout reference")
+	index := NewManifestsIndex(&types.SystemContext{})
+	err = index.FetchManifests(context.Background(), ref)
+	require.NoError(t, err, "unable to fetch manifests")
+	assert.Equal(t, list.Digest, index.Digest())
+
+	manifests := index.Manifests()
+	require.Len(t, manifests, len(archs))
+	for i, man := range manifests {
+		layers := man.LayerInfos()
+		require.Len(t, layers, 2)
+		expected := digest.FromString(fmt.Sprintf("layer-%s", archs[i]))
+		assert.Equal(t, expected, layers[1].Digest, "manifests out of order")
+	}
+	assert.True(t, index.HasLayer(digest.FromString("base")))
+	assert.False(t, index.HasLayer(digest.FromString("missing")))
+}
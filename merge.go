@@ -0,0 +1,297 @@
+package imo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+)
+
+// Merge composes a chain of incremental archives (e.g. v1 to v2 followed by v2 to
+// v3) into a single archive equal to the difference between the base of the first
+// archive and the final image of the last one (v1 to v3). Each archive base must be
+// the final image of the previous archive, as recorded in the archives metadata,
+// otherwise the merge fails. Layers needed by the last final image are taken from
+// the most recent archive holding them, layers introduced in between and no longer
+// used are left out. Referrers are taken from the last archive. Bundles are merged
+// image by image, matching them by name. The archives are decrypted and verified
+// as on Push and the result is encrypted and signed as on Pull. The caller is
+// responsible for closing the returned Diff.
+func (inc *Incremental) Merge(srcs ...string) (*Diff, error) {
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("no archives to merge")
+	}
+	tmpdir := path.Join(inc.tmpdir, uuid.New().String())
+	defer os.RemoveAll(tmpdir)
+	dirs := []string{}
+	mds := []*Metadata{}
+	for i, src := range srcs {
+		dir := path.Join(tmpdir, fmt.Sprintf("%d", i))
+		md, err := inc.extractArchive(src, dir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", src, err)
+		}
+		dirs = append(dirs, dir)
+		mds = append(mds, md)
+	}
+	if err := checkChain(srcs, mds); err != nil {
+		return nil, err
+	}
+	merger := &layoutMerger{
+		dirs:  dirs,
+		first: imagesByName(mds[0]),
+		dst:   path.Join(tmpdir, "merged"),
+	}
+	md, err := merger.merge(imagesByName(mds[len(mds)-1]))
+	if err != nil {
+		return nil, err
+	}
+	return inc.archive(merger.dst, md)
+}
+
+// extractArchive decrypts, verifies and extracts the archive pointed by src into
+// dir. Returns the archive metadata.
+func (inc *Incremental) extractArchive(src, dir string) (*Metadata, error) {
+	src, cleanup, err := inc.decryptArchive(src)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if err := inc.verifyArchive(src); err != nil {
+		return nil, fmt.Errorf("error verifying archive: %w", err)
+	}
+	if err := untar(src, dir); err != nil {
+		return nil, fmt.Errorf("error extracting archive: %w", err)
+	}
+	data, err := os.ReadFile(path.Join(dir, MetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %w", err)
+	}
+	var md Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %w", err)
+	}
+	return &md, nil
+}
+
+// imagesByName indexes the images in the metadata by their names.
+func imagesByName(md *Metadata) map[string]ImageMetadata {
+	images := map[string]ImageMetadata{}
+	for _, img := range md.Images {
+		images[img.Name] = img
+	}
+	return images
+}
+
+// pinnedDigest returns the digest of the provided reference. Returns an empty
+// digest for references not pinned by digest.
+func pinnedDigest(ref string) digest.Digest {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest()
+	}
+	return ""
+}
+
+// checkChain makes sure each archive base is the previous archive final image,
+// for all images in the archives.
+func checkChain(srcs []string, mds []*Metadata) error {
+	for i := 1; i < len(mds); i++ {
+		prev := imagesByName(mds[i-1])
+		curr := imagesByName(mds[i])
+		if len(prev) != len(curr) {
+			return fmt.Errorf("broken chain: %s and %s hold different images", srcs[i-1], srcs[i])
+		}
+		for name, img := range curr {
+			before, ok := prev[name]
+			if !ok {
+				return fmt.Errorf("broken chain: image %q from %s not found in %s", name, srcs[i], srcs[i-1])
+			}
+			base, final := pinnedDigest(img.Base), pinnedDigest(before.Final)
+			if base == "" || base != final {
+				return fmt.Errorf(
+					"broken chain: %s base %s is not %s final %s",
+					srcs[i], img.Base, srcs[i-1], before.Final,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// layoutMerger builds an oci layout holding the final images of the last of a
+// chain of extracted archives, stored in dirs, taking each blob from the most
+// recent archive holding it.
+type layoutMerger struct {
+	dirs  []string
+	first map[string]ImageMetadata
+	dst   string
+}
+
+// merge writes the merged layout and returns its metadata. The provided images
+// are the ones in the last archive.
+func (m *layoutMerger) merge(last map[string]ImageMetadata) (Metadata, error) {
+	lastdir := m.dirs[len(m.dirs)-1]
+	if err := os.MkdirAll(path.Join(m.dst, imgspecv1.ImageBlobsDir), 0o755); err != nil {
+		return Metadata{}, fmt.Errorf("error creating layout: %w", err)
+	}
+	for _, fname := range []string{imgspecv1.ImageLayoutFile, imgspecv1.ImageIndexFile} {
+		if err := copyFile(path.Join(lastdir, fname), path.Join(m.dst, fname)); err != nil {
+			return Metadata{}, fmt.Errorf("error copying %s: %w", fname, err)
+		}
+	}
+	data, err := os.ReadFile(path.Join(lastdir, imgspecv1.ImageIndexFile))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error reading index: %w", err)
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return Metadata{}, fmt.Errorf("error parsing index: %w", err)
+	}
+	md := Metadata{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imgspecv1.AnnotationRefName]
+		img, ok := last[name]
+		if !ok {
+			return Metadata{}, fmt.Errorf("image %q not found in metadata", name)
+		}
+		omitted := map[digest.Digest]bool{}
+		if err := m.manifest(desc, m.first[name], omitted); err != nil {
+			return Metadata{}, fmt.Errorf("error merging image %q: %w", name, err)
+		}
+		for _, referrer := range img.Referrers {
+			if err := m.manifest(referrer.Manifest, m.first[name], omitted); err != nil {
+				return Metadata{}, fmt.Errorf("error merging image %q referrer: %w", name, err)
+			}
+		}
+		merged := ImageMetadata{
+			Name:      name,
+			Base:      m.first[name].Base,
+			Final:     img.Final,
+			Omitted:   []digest.Digest{},
+			Referrers: img.Referrers,
+		}
+		for dgst := range omitted {
+			merged.Omitted = append(merged.Omitted, dgst)
+		}
+		slices.Sort(merged.Omitted)
+		md.Images = append(md.Images, merged)
+	}
+	return md, nil
+}
+
+// manifest copies the manifest pointed by desc, and everything it refers to, into
+// the merged layout. Layers not found in any archive must have been omitted from
+// the first one, they are recorded in the omitted map.
+func (m *layoutMerger) manifest(desc imgspecv1.Descriptor, first ImageMetadata, omitted map[digest.Digest]bool) error {
+	if found, err := m.copyBlob(desc.Digest); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("manifest %s not found", desc.Digest)
+	}
+	raw, err := os.ReadFile(m.blobPath(m.dst, desc.Digest))
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %w", desc.Digest, err)
+	}
+	mime := desc.MediaType
+	if mime == "" {
+		mime = manifest.GuessMIMEType(raw)
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for _, instance := range list.Instances() {
+			child := imgspecv1.Descriptor{Digest: instance}
+			if info, err := list.Instance(instance); err == nil {
+				child.MediaType = info.MediaType
+			}
+			if err := m.manifest(child, first, omitted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+	}
+	if found, err := m.copyBlob(man.ConfigInfo().Digest); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("config %s not found", man.ConfigInfo().Digest)
+	}
+	for _, layer := range man.LayerInfos() {
+		if found, err := m.copyBlob(layer.Digest); err != nil {
+			return err
+		} else if found {
+			continue
+		}
+		if !slices.Contains(first.Omitted, layer.Digest) {
+			return fmt.Errorf("layer %s found in no archive and not omitted from the first one", layer.Digest)
+		}
+		omitted[layer.Digest] = true
+	}
+	return nil
+}
+
+// blobPath returns the path for the blob in the layout stored in dir.
+func (m *layoutMerger) blobPath(dir string, dgst digest.Digest) string {
+	return path.Join(dir, imgspecv1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// copyBlob copies the blob into the merged layout, from the most recent archive
+// holding it. Returns false if the blob is not found in any archive.
+func (m *layoutMerger) copyBlob(dgst digest.Digest) (bool, error) {
+	dst := m.blobPath(m.dst, dgst)
+	if _, err := os.Stat(dst); err == nil {
+		return true, nil
+	}
+	for i := len(m.dirs) - 1; i >= 0; i-- {
+		src := m.blobPath(m.dirs[i], dgst)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(dst), 0o755); err != nil {
+			return false, fmt.Errorf("error creating blobs directory: %w", err)
+		}
+		if err := os.Link(src, dst); err == nil {
+			return true, nil
+		}
+		if err := copyFile(src, dst); err != nil {
+			return false, fmt.Errorf("error copying blob %s: %w", dgst, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// copyFile copies the file pointed by src into dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,75 @@
+package imo
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pinnedRef returns a reference pinned to a digest derived from the version.
+func pinnedRef(version string) string {
+	return "registry.example.com/app@" + digest.FromString(version).String()
+}
+
+// chainArchive writes an archive holding an image made of the provided layers,
+// omitting the ones listed, and returns its path.
+func chainArchive(t *testing.T, base, final string, layers []string, omit ...string) string {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", layers...))
+	md := ImageMetadata{Base: pinnedRef(base), Final: pinnedRef(final), Omitted: []digest.Digest{}}
+	for _, layer := range omit {
+		dgst := digest.FromString(layer)
+		require.NoError(t, os.Remove(filepath.Join(dir, "blobs", "sha256", dgst.Encoded())))
+		md.Omitted = append(md.Omitted, dgst)
+	}
+	require.NoError(t, writeMetadata(dir, Metadata{Images: []ImageMetadata{md}}))
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(dir, tpath), "unable to create tarball")
+	return tpath
+}
+
+func TestMerge(t *testing.T) {
+	first := chainArchive(t, "v1", "v2", []string{"a", "c", "e"}, "a")
+	second := chainArchive(t, "v2", "v3", []string{"a", "c", "d"}, "a", "c")
+
+	diff, err := New().Merge(first, second)
+	require.NoError(t, err, "unable to merge archives")
+	defer diff.Close()
+	require.Len(t, diff.Metadata.Images, 1)
+	img := diff.Metadata.Images[0]
+	assert.Equal(t, pinnedRef("v1"), img.Base)
+	assert.Equal(t, pinnedRef("v3"), img.Final)
+	assert.Equal(t, []digest.Digest{digest.FromString("a")}, img.Omitted)
+
+	tpath := filepath.Join(t.TempDir(), "merged.tar")
+	fp, err := os.Create(tpath)
+	require.NoError(t, err)
+	_, err = io.Copy(fp, diff)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+	require.NoError(t, Verify(tpath), "merged archive does not verify")
+
+	dir := t.TempDir()
+	require.NoError(t, untar(tpath, dir))
+	for layer, expected := range map[string]bool{"a": false, "c": true, "d": true, "e": false} {
+		dgst := digest.FromString(layer)
+		_, err := os.Stat(filepath.Join(dir, "blobs", "sha256", dgst.Encoded()))
+		assert.Equal(t, expected, err == nil, "unexpected presence of layer %s", layer)
+	}
+}
+
+func TestMergeBrokenChain(t *testing.T) {
+	first := chainArchive(t, "v1", "v2", []string{"a", "c"}, "a")
+	second := chainArchive(t, "v3", "v4", []string{"a", "c", "d"}, "a", "c")
+	_, err := New().Merge(first, second)
+	assert.ErrorContains(t, err, "broken chain")
+
+	_, err = New().Merge()
+	assert.Error(t, err, "merging nothing should fail")
+}
@@ -0,0 +1,87 @@
+package imo
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// MetadataFile is the name of the file, stored in the root of the incremental
+// archive, holding the archive Metadata.
+const MetadataFile = "imo.json"
+
+// Metadata describes how an incremental archive was produced. It is stored in the
+// archive alongside the oci layout. Archives created by PullBundle contain one
+// entry per image, other archives contain a single entry.
+type Metadata struct {
+	Images []ImageMetadata `json:"images"`
+}
+
+// ImageMetadata describes how the incremental difference for an image has been
+// calculated. Name is the image name inside a bundle (empty for archives holding
+// a single image). Base and Final are the references used, pinned by digest. Base
+// is 'scratch' if all layers are included and empty if the difference has been
+// calculated against an Inventory. Omitted lists the layers left out of the
+// archive because they are already present on the other side. Referrers lists the
+// artifacts referring to the final image included in the archive (see
+// WithReferrers).
+type ImageMetadata struct {
+	Name      string          `json:"name,omitempty"`
+	Base      string          `json:"base,omitempty"`
+	Final     string          `json:"final"`
+	Omitted   []digest.Digest `json:"omitted,omitempty"`
+	Referrers []Referrer      `json:"referrers,omitempty"`
+}
+
+// Diff is an incremental difference produced by one of the Pull operations. It
+// is read as an oci-archive tarball, the caller is responsible for closing it.
+// Metadata describes how the difference has been calculated, it is also stored
+// in the archive.
+type Diff struct {
+	io.ReadCloser
+	Metadata Metadata
+}
+
+// writeMetadata writes the metadata into the oci layout stored in dir.
+func writeMetadata(dir string, md Metadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding metadata: %w", err)
+	}
+	if err := os.WriteFile(path.Join(dir, MetadataFile), data, 0o644); err != nil {
+		return fmt.Errorf("error writing metadata: %w", err)
+	}
+	return nil
+}
+
+// LoadMetadata reads the metadata stored in the incremental archive pointed by
+// src.
+func LoadMetadata(src string) (*Metadata, error) {
+	fp, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer fp.Close()
+	tr := tar.NewReader(fp)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive has no %s", MetadataFile)
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+		if path.Clean(hdr.Name) != MetadataFile {
+			continue
+		}
+		var md Metadata
+		if err := json.NewDecoder(tr).Decode(&md); err != nil {
+			return nil, fmt.Errorf("error decoding metadata: %w", err)
+		}
+		return &md, nil
+	}
+}
@@ -0,0 +1,41 @@
+package imo
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMetadata(t *testing.T) {
+	dir := t.TempDir()
+	newTestLayout(t, dir)
+	md := Metadata{
+		Images: []ImageMetadata{
+			{
+				Base:  "quay.io/myorg/app@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+				Final: "quay.io/myorg/app@sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			},
+		},
+	}
+	err := writeMetadata(dir, md)
+	require.NoError(t, err, "unable to write metadata")
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err = tarball(dir, tpath)
+	require.NoError(t, err, "unable to create tarball")
+
+	loaded, err := LoadMetadata(tpath)
+	require.NoError(t, err, "unable to load metadata")
+	assert.Equal(t, md, *loaded)
+}
+
+func TestLoadMetadataMissing(t *testing.T) {
+	dir := t.TempDir()
+	newTestLayout(t, dir)
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err := tarball(dir, tpath)
+	require.NoError(t, err, "unable to create tarball")
+	_, err = LoadMetadata(tpath)
+	assert.Error(t, err, "archive without metadata should fail")
+}
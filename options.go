@@ -4,6 +4,7 @@ import (
 	"io"
 
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/pkg/compression"
 	"go.podman.io/image/v5/types"
 )
 
@@ -90,3 +91,213 @@ func WithAllArchitectures() Option {
 		inc.selection = copy.CopyAllImages
 	}
 }
+
+// WithMaxParallelTransfers sets the maximum number of blobs transferred at the same
+// time during Pull and Push. By default a reasonable value is chosen by the copy
+// library.
+func WithMaxParallelTransfers(max uint) Option {
+	return func(inc *Incremental) {
+		inc.parallel = max
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry failed registry operations during
+// Pull and Push. By default operations are not retried, rate limited operations
+// are handled separately (see WithRateLimitPolicy).
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(inc *Incremental) {
+		inc.retry = policy
+	}
+}
+
+// WithRateLimit limits both Pull and Push to bytesPerSec bytes per second. Pull and
+// Push are throttled independently, each one of them can transfer up to the limit.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(inc *Incremental) {
+		inc.pullLimiter = NewRateLimiter(bytesPerSec)
+		inc.pushLimiter = NewRateLimiter(bytesPerSec)
+	}
+}
+
+// WithPullRateLimiter throttles Pull using the provided RateLimiter. Callers can keep
+// a reference to the RateLimiter and change the limit at runtime.
+func WithPullRateLimiter(limiter *RateLimiter) Option {
+	return func(inc *Incremental) {
+		inc.pullLimiter = limiter
+	}
+}
+
+// WithPushRateLimiter throttles Push using the provided RateLimiter. Callers can keep
+// a reference to the RateLimiter and change the limit at runtime.
+func WithPushRateLimiter(limiter *RateLimiter) Option {
+	return func(inc *Incremental) {
+		inc.pushLimiter = limiter
+	}
+}
+
+// WithArchiveCompression recompresses the layers shipped in the incremental archive
+// using the provided algorithm and level (e.g. compression.Zstd with a high level).
+// Layers left out of the archive are not affected. Be aware that recompressed layers
+// have different digests so the pushed manifest differs from the original one.
+func WithArchiveCompression(algo compression.Algorithm, level int) Option {
+	return func(inc *Incremental) {
+		inc.pullFormat = &algo
+		inc.pullLevel = &level
+	}
+}
+
+// WithPushCompression recompresses, while pushing, the layers shipped in the archive
+// using the provided algorithm and level. This is useful to push layers using the
+// compression expected by the destination (e.g. compression.Gzip) after they were
+// recompressed with WithArchiveCompression. Recompressed layers never get their
+// original digests back, even when the original algorithm is used, so the pushed
+// manifest differs from the one in the source registry. Layers already present in
+// the destination registry are not affected. By default layers are pushed as they
+// are stored in the archive.
+func WithPushCompression(algo compression.Algorithm, level int) Option {
+	return func(inc *Incremental) {
+		inc.pushFormat = &algo
+		inc.pushLevel = &level
+	}
+}
+
+// WithPreserveDigests makes Pull and Push fail if the image manifest would need to
+// be modified, guaranteeing the manifest pushed to the destination is identical to
+// the one in the source registry. As the incremental archive is an oci-archive,
+// only images using OCI manifests can be preserved. This option can't be used
+// together with WithArchiveCompression, WithPushCompression or WithLayerDecryption,
+// operations fail if they are combined.
+func WithPreserveDigests() Option {
+	return func(inc *Incremental) {
+		inc.preserveDigests = true
+	}
+}
+
+// WithArchiveEncryption encrypts the whole incremental archive, using pgp, for the
+// provided recipients (armored or binary pgp public keys). Nothing in the archive,
+// manifests included, can be read without one of the recipients private keys so
+// PushVet also needs them. See WithArchiveDecryption.
+func WithArchiveEncryption(recipients ...[]byte) Option {
+	return func(inc *Incremental) {
+		inc.archiveRecipients = recipients
+	}
+}
+
+// WithArchiveDecryption sets the pgp private keys (armored or binary, without a
+// passphrase) used by the Push operations to decrypt archives encrypted with
+// WithArchiveEncryption. Archives that are not encrypted are read as they are.
+func WithArchiveDecryption(keys ...[]byte) Option {
+	return func(inc *Incremental) {
+		inc.archiveKeys = keys
+	}
+}
+
+// WithLayerEncryption encrypts, using ocicrypt, the layers shipped in the incremental
+// archive for the provided recipients (public keys in PEM or JWK format). Manifests
+// and configs stay readable so Verify and PushVet work without the private keys.
+// Layers left out of the archive are not encrypted. As manifests are rewritten
+// while encrypting, leaving referrers pointing to digests no longer present, this
+// option can't be used together with WithReferrers. See WithLayerDecryption.
+func WithLayerEncryption(recipients ...[]byte) Option {
+	return func(inc *Incremental) {
+		inc.layerRecipients = recipients
+	}
+}
+
+// WithLayerDecryption sets the private keys (PEM, DER or JWK format, without a
+// passphrase) used by Push to decrypt layers encrypted with WithLayerEncryption.
+// The original layers and manifests are pushed to the destination. As manifests
+// are modified while decrypting this option can't be used together with
+// WithPreserveDigests. Without decryption keys encrypted layers are pushed as
+// they are.
+func WithLayerDecryption(keys ...[]byte) Option {
+	return func(inc *Incremental) {
+		inc.layerKeys = keys
+	}
+}
+
+// WithSigningKey signs the incremental archives created by the Pull operations with
+// the provided PEM encoded private key (PKCS#1, PKCS#8, EC or an encrypted sigstore
+// or cosign key, in which case passphrase is used to decrypt it). The signature
+// covers the archive index and metadata and is stored in the archive. Only raw
+// keys are supported, keyless (Fulcio) signing, certificates and sigstore bundles
+// are not. See WithTrustedKeys.
+func WithSigningKey(key, passphrase []byte) Option {
+	return func(inc *Incremental) {
+		inc.signingKey = key
+		inc.signingPass = passphrase
+	}
+}
+
+// WithTrustedKeys sets the PEM encoded public keys archives must be signed with.
+// When set the Push operations, PushVet included, refuse archives that are not
+// signed or whose signature has not been made by one of the keys. Signatures are
+// checked against the keys alone, certificates, certificate chains and sigstore
+// bundles are not supported.
+func WithTrustedKeys(keys ...[]byte) Option {
+	return func(inc *Incremental) {
+		inc.trustedKeys = keys
+	}
+}
+
+// WithReferrers makes the Pull operations include, along with the final image, the
+// artifacts referring to it (e.g. signatures, SBOMs and attestations). Referrers are
+// discovered using the OCI referrers API, falling back to the referrers tag scheme,
+// and the cosign tag scheme. Referrers that can't be read fail the Pull. Artifacts
+// also referring to the base image are left out, as are their layers present in it.
+// Push re-attaches the included referrers to the destination repository, updating
+// the referrers tag index of their subjects. As artifacts refer to images by digest
+// WithPreserveDigests should be used so the pushed image keeps its digest.
+func WithReferrers() Option {
+	return func(inc *Incremental) {
+		inc.referrers = true
+	}
+}
+
+// WithCache sets the cache shared by all operations. Manifests are read from the
+// cache by digest, tagged references are resolved using the cache while the cached
+// resolution is fresh and the copies record what they learn about blobs in the
+// cache blob info cache. See NewDiskCache.
+func WithCache(cache Cache) Option {
+	return func(inc *Incremental) {
+		inc.cache = cache
+	}
+}
+
+// WithRateLimitPolicy sets how operations are retried while registries rate limit
+// us (HTTP 429). By default they are retried up to four times, waiting from thirty
+// seconds up to five minutes, or longer if the registry asks for it. Waits are
+// reported to the report writer.
+func WithRateLimitPolicy(policy RateLimitPolicy) Option {
+	return func(inc *Incremental) {
+		inc.rateLimit = policy
+	}
+}
+
+// WithRequestBudget limits the requests sent to the provided registry (e.g.
+// docker.io or quay.io) according to the budget. If registry is empty the budget
+// applies, separately, to each registry without a budget of its own. Operations
+// wait until the budget allows them, long waits are reported to the report writer.
+func WithRequestBudget(registry string, budget RequestBudget) Option {
+	return func(inc *Incremental) {
+		if inc.budgets == nil {
+			inc.budgets = &budgets{
+				clock:    systemClock{},
+				budgets:  map[string]RequestBudget{},
+				limiters: map[string]*requestLimiter{},
+			}
+		}
+		inc.budgets.budgets[registry] = budget
+	}
+}
+
+// WithSyncIndexTags limits the images Sync looks at in the destination repository,
+// to tell which layers are already present, to the ones tagged with the provided
+// tags. By default all tags in the destination repository are looked at, costing
+// requests for each of them on large repositories. Tags that do not exist are
+// ignored. It has no effect when Sync is given base images.
+func WithSyncIndexTags(tags ...string) Option {
+	return func(inc *Incremental) {
+		inc.syncTags = tags
+	}
+}
@@ -0,0 +1,74 @@
+package imo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/types"
+)
+
+// pin parses the provided image reference and returns a docker reference pinned
+// by digest. References containing a digest are used as they are (any tag is
+// dropped), tagged references are resolved using the registry or, if a cache has
+// been configured, taken from the cache while the resolution is fresh.
+func (inc *Incremental) pin(ctx context.Context, sysctx *types.SystemContext, ref string) (types.ImageReference, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing reference %s: %w", ref, err)
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return inc.pinnedReference(reference.TrimNamed(named), digested.Digest())
+	}
+	named = reference.TagNameOnly(named)
+	if inc.cache != nil {
+		if dgst, ok := inc.cache.Digest(named.String()); ok {
+			return inc.pinnedReference(reference.TrimNamed(named), dgst)
+		}
+	}
+	dgst, err := inc.tagDigest(ctx, sysctx, named)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving digest for %s: %w", ref, err)
+	}
+	if inc.cache != nil {
+		inc.cache.PutDigest(named.String(), dgst)
+	}
+	return inc.pinnedReference(reference.TrimNamed(named), dgst)
+}
+
+// tagDigest asks the registry for the digest the tagged reference points to, the
+// cache is not used. The request consumes the registry request budget.
+func (inc *Incremental) tagDigest(ctx context.Context, sysctx *types.SystemContext, named reference.Named) (digest.Digest, error) {
+	tagged, err := docker.NewReference(named)
+	if err != nil {
+		return "", fmt.Errorf("error creating reference for %s: %w", named, err)
+	}
+	var dgst digest.Digest
+	if err := inc.withRetry(ctx, func() error {
+		if err := inc.spend(ctx, reference.Domain(named)); err != nil {
+			return err
+		}
+		dgst, err = docker.GetDigest(ctx, sysctx, tagged)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// pinnedReference returns a docker reference for the repository pinned by the
+// provided digest. Manifests read through the reference are cached if a cache
+// has been configured and registry operations consume the request budget.
+func (inc *Incremental) pinnedReference(repo reference.Named, dgst digest.Digest) (types.ImageReference, error) {
+	pinned, err := reference.WithDigest(repo, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("error pinning reference %s: %w", repo, err)
+	}
+	ref, err := docker.NewReference(pinned)
+	if err != nil {
+		return nil, err
+	}
+	return inc.cached(inc.budgeted(ref)), nil
+}
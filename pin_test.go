@@ -0,0 +1,24 @@
+package imo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinDigestedReference(t *testing.T) {
+	dgst := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	inc := New()
+	for _, ref := range []string{
+		"quay.io/myorg/app@" + dgst,
+		"quay.io/myorg/app:v1@" + dgst,
+	} {
+		pinned, err := inc.pin(context.Background(), nil, ref)
+		require.NoError(t, err, "unable to pin %s", ref)
+		assert.Equal(t, "quay.io/myorg/app@"+dgst, pinned.DockerReference().String())
+	}
+	_, err := inc.pin(context.Background(), nil, "Invalid Reference")
+	assert.Error(t, err, "invalid reference should fail")
+}
@@ -0,0 +1,209 @@
+package imo
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.podman.io/image/v5/types"
+)
+
+// maxThrottledRead is the maximum number of bytes read at once from a throttled
+// reader. Keeping reads small makes the transfer rate smoother.
+const maxThrottledRead = 32 * 1024
+
+// clock tells the time and waits, limiters use it so tests don't need to wait.
+type clock interface {
+	Now() time.Time
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// systemClock is the clock backed by the system time.
+type systemClock struct{}
+
+// Now returns the current time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep waits for the duration or until the context is done.
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RateLimiter is a token bucket limiting the number of bytes per second flowing
+// through the readers it throttles. The limit is shared among all the readers
+// and can be changed at any time, including while transfers are in progress.
+type RateLimiter struct {
+	mtx    sync.Mutex
+	clock  clock
+	limit  int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing up to bytesPerSec bytes per second.
+// A limit equal or lower than zero means unlimited.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return newRateLimiter(bytesPerSec, systemClock{})
+}
+
+// newRateLimiter returns a RateLimiter allowing up to bytesPerSec bytes per second
+// as measured by the provided clock.
+func newRateLimiter(bytesPerSec int64, clock clock) *RateLimiter {
+	return &RateLimiter{
+		clock:  clock,
+		limit:  bytesPerSec,
+		tokens: float64(bytesPerSec),
+		last:   clock.Now(),
+	}
+}
+
+// SetLimit changes the limit to bytesPerSec bytes per second. A limit equal or
+// lower than zero means unlimited.
+func (r *RateLimiter) SetLimit(bytesPerSec int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.refill()
+	r.limit = bytesPerSec
+	r.tokens = min(r.tokens, float64(bytesPerSec))
+}
+
+// Limit returns the current limit in bytes per second.
+func (r *RateLimiter) Limit() int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.limit
+}
+
+// Reader returns a reader throttled by the RateLimiter.
+func (r *RateLimiter) Reader(ctx context.Context, rd io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, reader: rd, limiter: r}
+}
+
+// refill adds the tokens accumulated since the last refill. The bucket holds at
+// most one second worth of tokens. Must be called with the mutex held.
+func (r *RateLimiter) refill() {
+	now := r.clock.Now()
+	elapsed := now.Sub(r.last).Seconds()
+	r.last = now
+	r.tokens = min(r.tokens+elapsed*float64(r.limit), float64(r.limit))
+}
+
+// wait consumes n tokens from the bucket, blocking until they are available or
+// the context is done.
+func (r *RateLimiter) wait(ctx context.Context, n int) error {
+	r.mtx.Lock()
+	if r.limit <= 0 {
+		r.mtx.Unlock()
+		return nil
+	}
+	r.refill()
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / float64(r.limit) * float64(time.Second))
+	}
+	r.mtx.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	return r.clock.Sleep(ctx, delay)
+}
+
+// throttledReader is a reader whose throughput is limited by a RateLimiter.
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+// Read reads from the underlying reader and then waits until the RateLimiter
+// allows the read bytes through.
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		if werr := t.limiter.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledReadCloser is a throttledReader that also closes the underlying reader.
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// throttledReference wraps an image reference so that all blobs read from its
+// sources or written to its destinations are throttled by a RateLimiter.
+type throttledReference struct {
+	types.ImageReference
+	limiter *RateLimiter
+}
+
+// NewImageSource returns a throttled image source.
+func (t *throttledReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := t.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledSource{ImageSource: src, limiter: t.limiter}, nil
+}
+
+// NewImageDestination returns a throttled image destination.
+func (t *throttledReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dst, err := t.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledDestination{ImageDestination: dst, limiter: t.limiter}, nil
+}
+
+// throttledSource is an image source whose blobs are read through a RateLimiter.
+type throttledSource struct {
+	types.ImageSource
+	limiter *RateLimiter
+}
+
+// GetBlob returns a throttled stream for the blob.
+func (t *throttledSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	blob, size, err := t.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return throttledReadCloser{t.limiter.Reader(ctx, blob), blob}, size, nil
+}
+
+// throttledDestination is an image destination whose blobs are written through a
+// RateLimiter.
+type throttledDestination struct {
+	types.ImageDestination
+	limiter *RateLimiter
+}
+
+// PutBlob writes the blob throttling the provided stream.
+func (t *throttledDestination) PutBlob(ctx context.Context, stream io.Reader, info types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	return t.ImageDestination.PutBlob(ctx, t.limiter.Reader(ctx, stream), info, cache, isConfig)
+}
+
+// throttle wraps the reference with the provided RateLimiter. If the limiter is
+// nil the reference is returned as is.
+func throttle(ref types.ImageReference, limiter *RateLimiter) types.ImageReference {
+	if limiter == nil {
+		return ref
+	}
+	return &throttledReference{ImageReference: ref, limiter: limiter}
+}
@@ -0,0 +1,79 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose time only moves when someone sleeps. It records the
+// total time slept.
+type fakeClock struct {
+	mtx   sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+// Now returns the fake current time.
+func (f *fakeClock) Now() time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.now
+}
+
+// Sleep moves the time forward, without waiting, unless the context is done.
+func (f *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.now = f.now.Add(d)
+	f.slept += d
+	return nil
+}
+
+// Slept returns the total time slept.
+func (f *fakeClock) Slept() time.Duration {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.slept
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newRateLimiter(64*1024, clock)
+	src := bytes.NewReader(make([]byte, 192*1024))
+	n, err := io.Copy(io.Discard, limiter.Reader(context.Background(), src))
+	require.NoError(t, err, "unable to read throttled content")
+	assert.Equal(t, int64(192*1024), n)
+	// the first second worth of bytes is available right away, the remaining
+	// 128KiB take two seconds.
+	assert.Equal(t, 2*time.Second, clock.Slept().Round(time.Millisecond), "reader was not throttled to the limit")
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newRateLimiter(1, clock)
+	limiter.SetLimit(0)
+	assert.Equal(t, int64(0), limiter.Limit())
+	src := bytes.NewReader(make([]byte, 1024*1024))
+	_, err := io.Copy(io.Discard, limiter.Reader(context.Background(), src))
+	require.NoError(t, err, "unable to read unlimited content")
+	assert.Zero(t, clock.Slept(), "unlimited reader was throttled")
+}
+
+func TestRateLimiterContextCancel(t *testing.T) {
+	limiter := newRateLimiter(1024, &fakeClock{now: time.Now()})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := bytes.NewReader(make([]byte, 1024*1024))
+	_, err := io.Copy(io.Discard, limiter.Reader(ctx, src))
+	assert.ErrorIs(t, err, context.Canceled)
+}
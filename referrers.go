@@ -0,0 +1,565 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/blobinfocache/none"
+	"go.podman.io/image/v5/types"
+)
+
+// cosignSuffixes are the suffixes of the tags used by cosign to attach signatures,
+// attestations and SBOMs to an image (e.g. sha256-<digest>.sig).
+var cosignSuffixes = []string{".sig", ".att", ".sbom"}
+
+// Referrer is an artifact (e.g. a signature, an SBOM or an attestation) referring
+// to an image. Subject is the digest of the image the artifact refers to and
+// Manifest describes the artifact manifest. Tag is set for artifacts attached
+// using the cosign tag scheme (e.g. sha256-<digest>.sig) and empty for artifacts
+// attached through the manifest subject field.
+type Referrer struct {
+	Subject  digest.Digest        `json:"subject"`
+	Manifest imgspecv1.Descriptor `json:"manifest"`
+	Tag      string               `json:"tag,omitempty"`
+}
+
+// referrersTag returns the tag the referrers tag scheme uses for the subject.
+func referrersTag(subject digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subject.Algorithm(), subject.Encoded())
+}
+
+// pullReferrers discovers the referrers of the final image described by md and
+// copies them into the oci layout stored in dir, recording them in md. Referrers
+// also found for the base image are already present on the other side and are
+// skipped. As with the image, referrer layers present in the index are left out
+// and recorded as omitted.
+func (inc *Incremental) pullReferrers(ctx context.Context, dir string, index LayerIndex, md *ImageMetadata) error {
+	referrers, err := inc.newReferrers(ctx, md.Final, md.Base)
+	if err != nil {
+		return err
+	}
+	finalref, err := docker.ParseReference(fmt.Sprintf("//%s", md.Final))
+	if err != nil {
+		return fmt.Errorf("error parsing final reference: %w", err)
+	}
+	src, err := throttle(inc.budgeted(finalref), inc.pullLimiter).NewImageSource(ctx, inc.finalSysctx())
+	if err != nil {
+		return fmt.Errorf("error creating source image: %w", err)
+	}
+	defer src.Close()
+	omitted := map[digest.Digest]bool{}
+	for _, dgst := range md.Omitted {
+		omitted[dgst] = true
+	}
+	for _, referrer := range referrers {
+		if err := inc.withRetry(ctx, func() error {
+			return copyReferrer(ctx, src, dir, referrer.Manifest, index, omitted)
+		}); err != nil {
+			return fmt.Errorf("error copying referrer %s: %w", referrer.Manifest.Digest, err)
+		}
+	}
+	md.Referrers = referrers
+	md.Omitted = slices.Sorted(maps.Keys(omitted))
+	return nil
+}
+
+// newReferrers discovers the referrers of the final image, both pinned by digest.
+// Referrers also found for any of the bases are already present on the other side
+// and are left out, as are duplicates. Bases equal to "scratch" are ignored.
+func (inc *Incremental) newReferrers(ctx context.Context, final string, bases ...string) ([]Referrer, error) {
+	finalref, err := docker.ParseReference(fmt.Sprintf("//%s", final))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing final reference: %w", err)
+	}
+	var referrers []Referrer
+	if err := inc.withRetry(ctx, func() error {
+		referrers, err = inc.discoverReferrers(ctx, inc.finalSysctx(), inc.budgeted(finalref))
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("error discovering referrers: %w", err)
+	}
+	skip := map[digest.Digest]bool{}
+	sysctx := &types.SystemContext{DockerAuthConfig: inc.auths.BaseAuth}
+	for _, base := range bases {
+		if base == "" || base == "scratch" {
+			continue
+		}
+		baseref, err := docker.ParseReference(fmt.Sprintf("//%s", base))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing base reference: %w", err)
+		}
+		var existing []Referrer
+		if err := inc.withRetry(ctx, func() error {
+			existing, err = inc.discoverReferrers(ctx, sysctx, inc.budgeted(baseref))
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("error discovering base referrers: %w", err)
+		}
+		for _, referrer := range existing {
+			skip[referrer.Manifest.Digest] = true
+		}
+	}
+	selected := []Referrer{}
+	for _, referrer := range referrers {
+		if skip[referrer.Manifest.Digest] {
+			continue
+		}
+		skip[referrer.Manifest.Digest] = true
+		selected = append(selected, referrer)
+	}
+	return selected, nil
+}
+
+// discoverReferrers returns the referrers of the image pointed by ref and, if the
+// image is a manifest list, of each of its instances. Referrers are looked up using
+// the OCI referrers API, falling back to the referrers tag scheme on registries not
+// supporting it, and using the cosign tag scheme. The tags computed for each subject
+// are read directly.
+func (inc *Incremental) discoverReferrers(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) ([]Referrer, error) {
+	src, err := ref.NewImageSource(ctx, sysctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating source image: %w", err)
+	}
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	top, err := manifest.Digest(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating manifest digest: %w", err)
+	}
+	subjects := []digest.Digest{top}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing manifest list: %w", err)
+		}
+		subjects = append(subjects, list.Instances()...)
+	}
+	repo := reference.TrimNamed(ref.DockerReference())
+	referrers := []Referrer{}
+	for _, subject := range subjects {
+		tag := referrersTag(subject)
+		descs, ok, err := inc.referrersAPI(ctx, sysctx, repo, subject)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			_, raw, err := inc.tagManifest(ctx, sysctx, repo, tag)
+			if err != nil {
+				return nil, err
+			}
+			if raw != nil {
+				var index imgspecv1.Index
+				if err := json.Unmarshal(raw, &index); err != nil {
+					return nil, fmt.Errorf("error parsing referrers index %s: %w", tag, err)
+				}
+				descs = index.Manifests
+			}
+		}
+		for _, desc := range descs {
+			referrers = append(referrers, Referrer{Subject: subject, Manifest: desc})
+		}
+		for _, suffix := range cosignSuffixes {
+			desc, raw, err := inc.tagManifest(ctx, sysctx, repo, tag+suffix)
+			if err != nil {
+				return nil, err
+			} else if raw == nil {
+				continue
+			}
+			referrers = append(referrers, Referrer{Subject: subject, Manifest: desc, Tag: tag + suffix})
+		}
+	}
+	return referrers, nil
+}
+
+// referrersAPI lists, using the OCI referrers API, the artifacts referring to the
+// subject in the repository. Returns false if the registry does not support the
+// API, or refuses to answer it, in which case the referrers tag scheme is to be
+// used instead.
+func (inc *Incremental) referrersAPI(ctx context.Context, sysctx *types.SystemContext, repo reference.Named, subject digest.Digest) ([]imgspecv1.Descriptor, bool, error) {
+	digested, err := reference.WithDigest(repo, subject)
+	if err != nil {
+		return nil, false, fmt.Errorf("error creating reference for %s: %w", subject, err)
+	}
+	if err := inc.spend(ctx, reference.Domain(repo)); err != nil {
+		return nil, false, err
+	}
+	resp, err := registryGet(ctx, sysctx, digested, "referrers/"+subject.String(), imgspecv1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, false, fmt.Errorf("error querying referrers: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusMethodNotAllowed:
+		return nil, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, false, &RateLimitError{
+			Registry:   reference.Domain(repo),
+			RetryAfter: parseRetryAfter(resp),
+		}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, false, docker.UnexpectedHTTPStatusError{StatusCode: resp.StatusCode}
+	default:
+		fmt.Fprintf(inc.report, "referrers API of %s answered %s, using the referrers tag scheme\n", repo, resp.Status)
+		return nil, false, nil
+	}
+	var index imgspecv1.Index
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+		return nil, false, fmt.Errorf("error parsing referrers of %s: %w", subject, err)
+	}
+	if index.MediaType != imgspecv1.MediaTypeImageIndex {
+		return nil, false, nil
+	}
+	return index.Manifests, true, nil
+}
+
+// tagManifest reads the manifest tagged as tag in the repository. Returns its
+// descriptor and content or no content if the tag does not exist. Tags failing
+// to be read for any other reason (e.g. denied access) fail the lookup, the
+// artifacts they hold are not silently left out.
+func (inc *Incremental) tagManifest(ctx context.Context, sysctx *types.SystemContext, repo reference.Named, tag string) (imgspecv1.Descriptor, []byte, error) {
+	tagged, err := reference.WithTag(repo, tag)
+	if err != nil {
+		return imgspecv1.Descriptor{}, nil, fmt.Errorf("error creating reference for tag %s: %w", tag, err)
+	}
+	tagref, err := docker.NewReference(tagged)
+	if err != nil {
+		return imgspecv1.Descriptor{}, nil, fmt.Errorf("error creating reference for tag %s: %w", tag, err)
+	}
+	var raw []byte
+	var mime string
+	src, err := inc.budgeted(tagref).NewImageSource(ctx, sysctx)
+	if err == nil {
+		defer src.Close()
+		raw, mime, err = src.GetManifest(ctx, nil)
+	}
+	switch {
+	case err == nil:
+	case isManifestUnknown(err):
+		return imgspecv1.Descriptor{}, nil, nil
+	default:
+		return imgspecv1.Descriptor{}, nil, fmt.Errorf("error reading manifest for tag %s: %w", tag, err)
+	}
+	dgst, err := manifest.Digest(raw)
+	if err != nil {
+		return imgspecv1.Descriptor{}, nil, fmt.Errorf("error calculating digest for tag %s: %w", tag, err)
+	}
+	desc := imgspecv1.Descriptor{
+		MediaType: mime,
+		Digest:    dgst,
+		Size:      int64(len(raw)),
+	}
+	return desc, raw, nil
+}
+
+// isManifestUnknown returns true if the error has been caused by a manifest, or
+// the repository holding it, that does not exist in the registry.
+func isManifestUnknown(err error) bool {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) && coder.ErrorCode() == v2.ErrorCodeManifestUnknown {
+		return true
+	}
+	return isRepositoryUnknown(err)
+}
+
+// copyReferrer copies the artifact manifest pointed by desc, and the blobs it
+// refers to, from src into the oci layout stored in dir. Blobs already present in
+// the layout are not copied again and layers present in the index are left out,
+// they are recorded in the omitted map.
+func copyReferrer(ctx context.Context, src types.ImageSource, dir string, desc imgspecv1.Descriptor, index LayerIndex, omitted map[digest.Digest]bool) error {
+	raw, mime, err := src.GetManifest(ctx, &desc.Digest)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	if err := writeLayoutBlob(dir, desc.Digest, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	if desc.MediaType != "" {
+		mime = desc.MediaType
+	}
+	// docker and oci manifests (and lists) share the fields we are interested in.
+	if manifest.MIMETypeIsMultiImage(mime) {
+		var list imgspecv1.Index
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for _, child := range list.Manifests {
+			if err := copyReferrer(ctx, src, dir, child, index, omitted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var man imgspecv1.Manifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+	}
+	for i, blob := range append([]imgspecv1.Descriptor{man.Config}, man.Layers...) {
+		if blob.Digest == "" {
+			continue
+		}
+		if i > 0 && index.HasLayer(blob.Digest) {
+			omitted[blob.Digest] = true
+			continue
+		}
+		if _, err := os.Stat(layoutBlobPath(dir, blob.Digest)); err == nil {
+			continue
+		}
+		info := types.BlobInfo{Digest: blob.Digest, Size: blob.Size}
+		rd, _, err := src.GetBlob(ctx, info, none.NoCache)
+		if err != nil {
+			return fmt.Errorf("error reading blob %s: %w", blob.Digest, err)
+		}
+		err = writeLayoutBlob(dir, blob.Digest, rd)
+		rd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layoutBlobPath returns the path for the blob in the oci layout stored in dir.
+func layoutBlobPath(dir string, dgst digest.Digest) string {
+	return path.Join(dir, imgspecv1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// writeLayoutBlob writes the content read from r as a blob into the oci layout
+// stored in dir. The content is checked against the digest.
+func writeLayoutBlob(dir string, dgst digest.Digest, r io.Reader) error {
+	dst := layoutBlobPath(dir, dgst)
+	if err := os.MkdirAll(path.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("error creating blobs directory: %w", err)
+	}
+	tmp := fmt.Sprintf("%s.tmp", dst)
+	defer os.Remove(tmp)
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating blob %s: %w", dgst, err)
+	}
+	defer fp.Close()
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(io.MultiWriter(fp, verifier), r); err != nil {
+		return fmt.Errorf("error writing blob %s: %w", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s content does not match its digest", dgst)
+	}
+	if err := fp.Close(); err != nil {
+		return fmt.Errorf("error writing blob %s: %w", dgst, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("error moving blob %s: %w", dgst, err)
+	}
+	return nil
+}
+
+// pushReferrers attaches the referrers, read from the image pointed by srcref, to
+// the repository pointed by dst. Blobs already present in the repository are not
+// uploaded again.
+func (inc *Incremental) pushReferrers(ctx context.Context, srcref types.ImageReference, dst string, referrers []Referrer) error {
+	if len(referrers) == 0 {
+		return nil
+	}
+	src, err := srcref.NewImageSource(ctx, &types.SystemContext{})
+	if err != nil {
+		return fmt.Errorf("error creating source image: %w", err)
+	}
+	defer src.Close()
+	return inc.forEachReferrer(ctx, dst, referrers, func(dest types.ImageDestination, referrer Referrer) error {
+		return putReferrer(ctx, src, dest, referrer.Manifest, nil)
+	})
+}
+
+// forEachReferrer opens, for each referrer, a destination in the repository pointed
+// by dst and calls fn to write the referrer into it. Artifacts attached through the
+// subject field are written by digest, and listed in the referrers tag index of
+// their subject, while artifacts attached using the cosign tag scheme are written
+// to their tags. Each referrer is retried on its own.
+func (inc *Incremental) forEachReferrer(ctx context.Context, dst string, referrers []Referrer, fn func(types.ImageDestination, Referrer) error) error {
+	named, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	repo := reference.TrimNamed(named)
+	sysctx := &types.SystemContext{
+		DockerAuthConfig:            inc.auths.PushAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePush,
+	}
+	for _, referrer := range referrers {
+		var dstref types.ImageReference
+		if referrer.Tag == "" {
+			dstref, err = docker.NewReferenceUnknownDigest(repo)
+		} else {
+			var tagged reference.NamedTagged
+			if tagged, err = reference.WithTag(repo, referrer.Tag); err == nil {
+				dstref, err = docker.NewReference(tagged)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error creating reference for referrer %s: %w", referrer.Manifest.Digest, err)
+		}
+		if err := inc.withRetry(ctx, func() error {
+			dest, err := throttle(inc.budgeted(dstref), inc.pushLimiter).NewImageDestination(ctx, sysctx)
+			if err != nil {
+				return fmt.Errorf("error creating destination: %w", err)
+			}
+			defer dest.Close()
+			if err := fn(dest, referrer); err != nil {
+				return err
+			}
+			return dest.Commit(ctx, nil)
+		}); err != nil {
+			return fmt.Errorf("error pushing referrer %s: %w", referrer.Manifest.Digest, err)
+		}
+	}
+	return inc.tagReferrers(ctx, sysctx, repo, referrers)
+}
+
+// tagReferrers creates, or merges into, the referrers tag index of each subject
+// the artifacts attached through the subject field refer to, in the repository.
+// This is how discoverReferrers finds them on registries not supporting the OCI
+// referrers API. Artifacts already listed in an existing index are kept.
+func (inc *Incremental) tagReferrers(ctx context.Context, sysctx *types.SystemContext, repo reference.Named, referrers []Referrer) error {
+	subjects := []digest.Digest{}
+	descs := map[digest.Digest][]imgspecv1.Descriptor{}
+	for _, referrer := range referrers {
+		if referrer.Tag != "" {
+			continue
+		}
+		if _, ok := descs[referrer.Subject]; !ok {
+			subjects = append(subjects, referrer.Subject)
+		}
+		descs[referrer.Subject] = append(descs[referrer.Subject], referrer.Manifest)
+	}
+	for _, subject := range subjects {
+		tag := referrersTag(subject)
+		if err := inc.withRetry(ctx, func() error {
+			_, raw, err := inc.tagManifest(ctx, sysctx, repo, tag)
+			if err != nil {
+				return err
+			}
+			index := imgspecv1.Index{
+				Versioned: imgspecs.Versioned{SchemaVersion: 2},
+				MediaType: imgspecv1.MediaTypeImageIndex,
+				Manifests: []imgspecv1.Descriptor{},
+			}
+			if raw != nil {
+				if err := json.Unmarshal(raw, &index); err != nil {
+					return fmt.Errorf("error parsing referrers index %s: %w", tag, err)
+				}
+			}
+			changed := false
+			for _, desc := range descs[subject] {
+				if slices.ContainsFunc(index.Manifests, func(listed imgspecv1.Descriptor) bool {
+					return listed.Digest == desc.Digest
+				}) {
+					continue
+				}
+				index.Manifests = append(index.Manifests, desc)
+				changed = true
+			}
+			if !changed {
+				return nil
+			}
+			data, err := json.Marshal(index)
+			if err != nil {
+				return fmt.Errorf("error encoding referrers index %s: %w", tag, err)
+			}
+			tagged, err := reference.WithTag(repo, tag)
+			if err != nil {
+				return fmt.Errorf("error creating reference for tag %s: %w", tag, err)
+			}
+			tagref, err := docker.NewReference(tagged)
+			if err != nil {
+				return fmt.Errorf("error creating reference for tag %s: %w", tag, err)
+			}
+			dest, err := throttle(inc.budgeted(tagref), inc.pushLimiter).NewImageDestination(ctx, sysctx)
+			if err != nil {
+				return fmt.Errorf("error creating destination: %w", err)
+			}
+			defer dest.Close()
+			if err := dest.PutManifest(ctx, data, nil); err != nil {
+				return fmt.Errorf("error writing referrers index %s: %w", tag, err)
+			}
+			return dest.Commit(ctx, nil)
+		}); err != nil {
+			return fmt.Errorf("error tagging referrers of %s: %w", subject, err)
+		}
+	}
+	return nil
+}
+
+// putReferrer uploads the artifact manifest pointed by desc, and the blobs it
+// refers to, from src into dest. Children of manifest lists are pushed by their
+// digest, passed as instance.
+func putReferrer(ctx context.Context, src types.ImageSource, dest types.ImageDestination, desc imgspecv1.Descriptor, instance *digest.Digest) error {
+	raw, mime, err := src.GetManifest(ctx, &desc.Digest)
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %w", desc.Digest, err)
+	}
+	if desc.MediaType != "" {
+		mime = desc.MediaType
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		var index imgspecv1.Index
+		if err := json.Unmarshal(raw, &index); err != nil {
+			return fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for _, child := range index.Manifests {
+			if err := putReferrer(ctx, src, dest, child, &child.Digest); err != nil {
+				return err
+			}
+		}
+	} else {
+		var man imgspecv1.Manifest
+		if err := json.Unmarshal(raw, &man); err != nil {
+			return fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+		}
+		for i, blob := range append([]imgspecv1.Descriptor{man.Config}, man.Layers...) {
+			if blob.Digest == "" {
+				continue
+			}
+			info := types.BlobInfo{Digest: blob.Digest, Size: blob.Size}
+			found, _, err := dest.TryReusingBlob(ctx, info, none.NoCache, false)
+			if err != nil {
+				return fmt.Errorf("error checking blob %s in destination: %w", blob.Digest, err)
+			} else if found {
+				continue
+			}
+			rd, _, err := src.GetBlob(ctx, info, none.NoCache)
+			if err != nil {
+				return fmt.Errorf("error reading blob %s: %w", blob.Digest, err)
+			}
+			_, err = dest.PutBlob(ctx, rd, info, none.NoCache, i == 0)
+			rd.Close()
+			if err != nil {
+				return fmt.Errorf("error uploading blob %s: %w", blob.Digest, err)
+			}
+		}
+	}
+	if err := dest.PutManifest(ctx, raw, instance); err != nil {
+		return fmt.Errorf("error pushing manifest %s: %w", desc.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// sbom writes into the layout an artifact referring to the provided subject and
+// returns the artifact manifest descriptor.
+func (l *testLayout) sbom(t *testing.T, subject imgspecv1.Descriptor, content string) imgspecv1.Descriptor {
+	subject.Platform = nil
+	man := imgspecv1.Manifest{
+		Versioned:    imgspecs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/spdx+json",
+		Config:       l.blob(t, imgspecv1.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []imgspecv1.Descriptor{l.blob(t, "application/spdx+json", []byte(content))},
+		Subject:      &subject,
+	}
+	return l.json(t, imgspecv1.MediaTypeImageManifest, man)
+}
+
+func TestDiscoverReferrers(t *testing.T) {
+	encode := func(obj any) []byte {
+		data, err := json.Marshal(obj)
+		require.NoError(t, err, "unable to encode manifest")
+		return data
+	}
+	image := encode(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 6},
+	})
+	subject := digest.FromBytes(image)
+	sbom := imgspecv1.Descriptor{
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/spdx+json",
+		Digest:       digest.FromString("sbom"),
+		Size:         4,
+	}
+	signature := encode(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: imgspecv1.DescriptorEmptyJSON.Digest, Size: 2},
+	})
+	tag := referrersTag(subject)
+	registry := newFakeRegistry(t)
+	registry.put("repo", "v1", image)
+	registry.put("repo", tag, encode(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{sbom},
+	}))
+	registry.put("repo", tag+".sig", signature)
+
+	named, err := reference.ParseNormalizedNamed(registry.host() + "/repo:v1")
+	require.NoError(t, err, "unable to parse reference")
+	ref, err := docker.NewReference(named)
+	require.NoError(t, err, "unable to create reference")
+	ctx := context.Background()
+	inc := New()
+	referrers, err := inc.discoverReferrers(ctx, registry.sysctx(), ref)
+	require.NoError(t, err, "unable to discover referrers")
+	require.Len(t, referrers, 2, "referrers index and signature should be found")
+	assert.Equal(t, Referrer{Subject: subject, Manifest: sbom}, referrers[0])
+	assert.Equal(t, subject, referrers[1].Subject)
+	assert.Equal(t, tag+".sig", referrers[1].Tag)
+	assert.Equal(t, digest.FromBytes(signature), referrers[1].Manifest.Digest)
+
+	attestation := encode(imgspecv1.Manifest{
+		Versioned:    imgspecs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.in-toto+json",
+		Config:       imgspecv1.DescriptorEmptyJSON,
+		Subject:      &imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: subject, Size: int64(len(image))},
+	})
+	registry.put("repo", "", attestation)
+	registry.referrers = true
+	referrers, err = inc.discoverReferrers(ctx, registry.sysctx(), ref)
+	require.NoError(t, err, "unable to discover referrers")
+	require.Len(t, referrers, 2, "referrers API and signature should be used")
+	assert.Equal(t, digest.FromBytes(attestation), referrers[0].Manifest.Digest)
+	assert.Equal(t, "application/vnd.in-toto+json", referrers[0].Manifest.ArtifactType)
+	assert.Equal(t, tag+".sig", referrers[1].Tag)
+
+	registry.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".att") {
+			registry.fail(w, http.StatusForbidden, "DENIED")
+			return true
+		}
+		return false
+	}
+	_, err = inc.discoverReferrers(ctx, registry.sysctx(), ref)
+	assert.ErrorContains(t, err, tag+".att", "referrers that can't be read should fail")
+}
+
+func TestCopyReferrer(t *testing.T) {
+	ctx := context.Background()
+	srcdir := t.TempDir()
+	layout := newTestLayout(t, srcdir)
+	image := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", image)
+	artifact := layout.sbom(t, image, `{"spdxVersion":"SPDX-2.3"}`)
+
+	srcref, err := alltransports.ParseImageName("oci:" + srcdir)
+	require.NoError(t, err, "unable to parse source")
+	src, err := srcref.NewImageSource(ctx, &types.SystemContext{})
+	require.NoError(t, err, "unable to open source")
+	defer src.Close()
+
+	dir := t.TempDir()
+	omitted := map[digest.Digest]bool{}
+	require.NoError(t, copyReferrer(ctx, src, dir, artifact, layerIndexes{}, omitted), "unable to copy referrer")
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	require.NoError(t, err, "unable to read copied blobs")
+	assert.Len(t, entries, 3, "manifest, config and layer should be copied")
+	assert.Empty(t, omitted, "no layers should be omitted without index")
+
+	sbom := digest.FromString(`{"spdxVersion":"SPDX-2.3"}`)
+	index := &ManifestsIndex{index: map[digest.Digest]bool{sbom: true}}
+	dir = t.TempDir()
+	require.NoError(t, copyReferrer(ctx, src, dir, artifact, index, omitted), "unable to copy referrer")
+	_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", sbom.Encoded()))
+	assert.True(t, os.IsNotExist(err), "layer present on the other side should not be copied")
+	assert.Equal(t, map[digest.Digest]bool{sbom: true}, omitted, "left out layer should be recorded")
+
+	dstdir := t.TempDir()
+	dstref, err := alltransports.ParseImageName("oci:" + dstdir + ":sbom")
+	require.NoError(t, err, "unable to parse destination")
+	dest, err := dstref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err, "unable to create destination")
+	defer dest.Close()
+	require.NoError(t, putReferrer(ctx, src, dest, artifact, nil), "unable to push referrer")
+	require.NoError(t, dest.Commit(ctx, nil), "unable to commit referrer")
+	pushed, _ := readManifest(t, dstdir)
+	assert.Equal(t, artifact.Digest, pushed, "referrer should keep its digest")
+}
+
+func TestPushReferrers(t *testing.T) {
+	ctx := context.Background()
+	srcdir := t.TempDir()
+	layout := newTestLayout(t, srcdir)
+	image := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", image)
+	artifact := layout.sbom(t, image, `{"spdxVersion":"SPDX-2.3"}`)
+	raw, err := os.ReadFile(filepath.Join(srcdir, "blobs", "sha256", image.Digest.Encoded()))
+	require.NoError(t, err, "unable to read image manifest")
+
+	registry := newFakeRegistry(t)
+	registry.put("repo", "v1", raw)
+	existing := imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    digest.FromString("existing"),
+		Size:      8,
+	}
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{existing},
+	})
+	require.NoError(t, err, "unable to encode index")
+	registry.put("repo", referrersTag(image.Digest), index)
+
+	srcref, err := alltransports.ParseImageName("oci:" + srcdir)
+	require.NoError(t, err, "unable to parse source")
+	inc := New(WithInsecurePush())
+	referrers := []Referrer{{Subject: image.Digest, Manifest: artifact}}
+	require.NoError(t, inc.pushReferrers(ctx, srcref, registry.host()+"/repo:v1", referrers), "unable to push referrers")
+	_, ok := registry.manifest("repo", artifact.Digest.String())
+	assert.True(t, ok, "referrer should be pushed by digest")
+
+	named, err := reference.ParseNormalizedNamed(registry.host() + "/repo:v1")
+	require.NoError(t, err, "unable to parse reference")
+	ref, err := docker.NewReference(named)
+	require.NoError(t, err, "unable to create reference")
+	discovered, err := inc.discoverReferrers(ctx, registry.sysctx(), ref)
+	require.NoError(t, err, "unable to discover pushed referrers")
+	assert.Equal(t, []Referrer{
+		{Subject: image.Digest, Manifest: existing},
+		{Subject: image.Digest, Manifest: artifact},
+	}, discovered, "pushed referrer should be merged into the referrers tag index")
+
+	require.NoError(t, inc.pushReferrers(ctx, srcref, registry.host()+"/repo:v1", referrers), "unable to push referrers again")
+	again, err := inc.discoverReferrers(ctx, registry.sysctx(), ref)
+	require.NoError(t, err, "unable to discover pushed referrers")
+	assert.Equal(t, discovered, again, "referrers should be listed once")
+}
+
+func TestVerifyReferrers(t *testing.T) {
+	src := t.TempDir()
+	layout := newTestLayout(t, src)
+	image := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", image)
+	artifact := layout.sbom(t, image, "sbom")
+	md := Metadata{
+		Images: []ImageMetadata{
+			{
+				Final:     "registry.example.com/image@" + image.Digest.String(),
+				Referrers: []Referrer{{Subject: image.Digest, Manifest: artifact}},
+			},
+		},
+	}
+	require.NoError(t, writeMetadata(src, md), "unable to write metadata")
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(src, tpath), "unable to create tarball")
+	assert.NoError(t, Verify(tpath), "archive with referrers should verify")
+
+	sbom := digest.FromString("sbom")
+	require.NoError(t, os.Remove(filepath.Join(src, "blobs", "sha256", sbom.Encoded())))
+	require.NoError(t, tarball(src, tpath), "unable to create tarball")
+	err := Verify(tpath)
+	assert.ErrorContains(t, err, "referrer", "missing referrer blob should fail verification")
+
+	md.Images[0].Omitted = []digest.Digest{sbom}
+	require.NoError(t, writeMetadata(src, md), "unable to write metadata")
+	require.NoError(t, tarball(src, tpath), "unable to create tarball")
+	assert.NoError(t, Verify(tpath), "omitted referrer blob should verify")
+}
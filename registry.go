@@ -0,0 +1,239 @@
+package imo
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/sysregistriesv2"
+	"go.podman.io/image/v5/pkg/tlsclientconfig"
+	"go.podman.io/image/v5/types"
+)
+
+// challengeParam matches the parameters of a WWW-Authenticate header.
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryGet sends a GET request for the resource (e.g. "referrers/<digest>") of
+// the repository pointed by ref, for the parts of the registry API c/image does not
+// expose. It honors what c/image honors when pulling from the same repository: the
+// registries configuration (mirrors, blocked and insecure registries), certificate
+// directories and the system context TLS and proxy settings. Sources are tried in
+// order, the first one not answering with not found is used. Only the credentials
+// set in the system context are presented and never to mirrors in other domains.
+func registryGet(ctx context.Context, sysctx *types.SystemContext, ref reference.Named, resource, accept string) (*http.Response, error) {
+	sources, err := pullSources(sysctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	var last *http.Response
+	var lasterr error
+	for _, source := range sources {
+		resp, err := sourceGet(ctx, sysctx, ref, source, resource, accept)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		if last != nil {
+			last.Body.Close()
+		}
+		last = resp
+		if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+			break
+		}
+	}
+	if last == nil {
+		return nil, lasterr
+	}
+	return last, nil
+}
+
+// pullSources returns the sources from where the repository pointed by ref is
+// pulled, as configured in the registries configuration.
+func pullSources(sysctx *types.SystemContext, ref reference.Named) ([]sysregistriesv2.PullSource, error) {
+	registry, err := sysregistriesv2.FindRegistry(sysctx, ref.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error loading registries configuration: %w", err)
+	}
+	if registry == nil {
+		return []sysregistriesv2.PullSource{{Reference: ref}}, nil
+	}
+	if registry.Blocked {
+		return nil, fmt.Errorf("registry %s is blocked", registry.Prefix)
+	}
+	sources, err := registry.PullSourcesFromReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("error reading registry sources: %w", err)
+	}
+	return sources, nil
+}
+
+// sourceGet sends the GET request to the provided source. Plain HTTP is attempted
+// if the source is insecure and can't be reached over HTTPS.
+func sourceGet(ctx context.Context, sysctx *types.SystemContext, ref reference.Named, source sysregistriesv2.PullSource, resource, accept string) (*http.Response, error) {
+	domain := reference.Domain(source.Reference)
+	tlsconf, err := registryTLSConfig(sysctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	tlsconf.InsecureSkipVerify = source.Endpoint.Insecure
+	if sysctx.DockerInsecureSkipTLSVerify != types.OptionalBoolUndefined {
+		tlsconf.InsecureSkipVerify = sysctx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	}
+	transport := tlsclientconfig.NewTransport()
+	transport.TLSClientConfig = tlsconf
+	if sysctx.DockerProxyURL != nil {
+		transport.Proxy = http.ProxyURL(sysctx.DockerProxyURL)
+	}
+	client := &http.Client{Transport: transport}
+
+	creds, token := sysctx.DockerAuthConfig, sysctx.DockerBearerRegistryToken
+	if domain != reference.Domain(ref) {
+		creds, token = nil, ""
+	}
+	// as c/image does, docker.io is served by a different host.
+	host := domain
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	repo := reference.Path(source.Reference)
+	endpoint := fmt.Sprintf("%s/v2/%s/%s", host, repo, resource)
+	get := func(scheme string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		if sysctx.DockerRegistryUserAgent != "" {
+			req.Header.Set("User-Agent", sysctx.DockerRegistryUserAgent)
+		}
+		return authorizedDo(ctx, client, req, repo, creds, token)
+	}
+	resp, err := get("https")
+	if err != nil && tlsconf.InsecureSkipVerify {
+		resp, err = get("http")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s: %w", domain, err)
+	}
+	return resp, nil
+}
+
+// registryTLSConfig returns the TLS configuration for the registry host, reading
+// the certificate directory c/image reads for it.
+func registryTLSConfig(sysctx *types.SystemContext, host string) (*tls.Config, error) {
+	tlsconf := &tls.Config{}
+	if sysctx.BaseTLSConfig != nil {
+		tlsconf = sysctx.BaseTLSConfig.Clone()
+	}
+	dirs := []string{
+		path.Join("/etc/containers/certs.d", host),
+		path.Join("/etc/docker/certs.d", host),
+	}
+	if sysctx.DockerCertPath != "" {
+		dirs = []string{sysctx.DockerCertPath}
+	} else if sysctx.DockerPerHostCertDirPath != "" {
+		dirs = []string{path.Join(sysctx.DockerPerHostCertDirPath, host)}
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if err := tlsclientconfig.SetupCertificates(dir, tlsconf); err != nil {
+			return nil, fmt.Errorf("error reading certificates for %s: %w", host, err)
+		}
+		break
+	}
+	return tlsconf, nil
+}
+
+// authorizedDo sends the request and, if the registry requires authentication,
+// sends it again using basic authentication or a bearer token with pull access to
+// the repository as requested by the registry. A bearer token set in the system
+// context is used as is.
+func authorizedDo(ctx context.Context, client *http.Client, req *http.Request, repo string, creds *types.DockerAuthConfig, token string) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if creds == nil {
+		creds = &types.DockerAuthConfig{}
+	}
+	scheme, _, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		req.SetBasicAuth(creds.Username, creds.Password)
+	case "bearer":
+		if token == "" {
+			if token, err = bearerToken(ctx, client, challenge, repo, creds); err != nil {
+				return nil, err
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	return client.Do(req)
+}
+
+// bearerToken requests a token as described by the bearer challenge, presenting
+// the provided credentials (if any). Pull access to the repository is requested
+// if the challenge does not carry a scope.
+func bearerToken(ctx context.Context, client *http.Client, challenge, repo string, creds *types.DockerAuthConfig) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication realm in %q", challenge)
+	}
+	if params["scope"] == "" {
+		params["scope"] = fmt.Sprintf("repository:%s:pull", repo)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if creds.Username != "" {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", &RateLimitError{Registry: req.URL.Host, RetryAfter: parseRetryAfter(resp)}
+	} else if resp.StatusCode != http.StatusOK {
+		return "", docker.UnexpectedHTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
@@ -0,0 +1,298 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// fakeRegistry is an in memory registry serving, over TLS, the parts of the
+// distribution API c/image uses to pull and push images and, if referrers is set,
+// the OCI referrers API. Requests for which intercept returns true are answered by
+// it instead.
+type fakeRegistry struct {
+	*httptest.Server
+	mtx       sync.Mutex
+	referrers bool
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+	manifests map[string]map[string][]byte
+	blobs     map[digest.Digest][]byte
+	uploads   map[string][]byte
+}
+
+// newFakeRegistry starts a fake registry, stopped when the test finishes.
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	registry := &fakeRegistry{
+		manifests: map[string]map[string][]byte{},
+		blobs:     map[digest.Digest][]byte{},
+		uploads:   map[string][]byte{},
+	}
+	registry.Server = httptest.NewTLSServer(registry)
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// host returns the registry host, to be used in image references.
+func (f *fakeRegistry) host() string {
+	return strings.TrimPrefix(f.URL, "https://")
+}
+
+// sysctx returns a system context trusting the registry certificate.
+func (f *fakeRegistry) sysctx() *types.SystemContext {
+	return &types.SystemContext{
+		DockerAuthConfig:            &types.DockerAuthConfig{},
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	}
+}
+
+// put stores the manifest in the repository, under its digest and the tag.
+func (f *fakeRegistry) put(repo, tag string, raw []byte) digest.Digest {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	dgst := digest.FromBytes(raw)
+	if f.manifests[repo] == nil {
+		f.manifests[repo] = map[string][]byte{}
+	}
+	f.manifests[repo][dgst.String()] = raw
+	if tag != "" {
+		f.manifests[repo][tag] = raw
+	}
+	return dgst
+}
+
+// load stores all the blobs of the oci layout in dir and stores, tagged as tag, the
+// manifest described by desc in the repository.
+func (f *fakeRegistry) load(t *testing.T, dir, repo, tag string, desc imgspecv1.Descriptor) {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	entries, err := os.ReadDir(blobs)
+	require.NoError(t, err, "unable to read layout blobs")
+	f.mtx.Lock()
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(blobs, entry.Name()))
+		require.NoError(t, err, "unable to read layout blob")
+		f.blobs[digest.NewDigestFromEncoded(digest.SHA256, entry.Name())] = data
+	}
+	raw := f.blobs[desc.Digest]
+	f.mtx.Unlock()
+	f.put(repo, tag, raw)
+}
+
+// manifest returns the manifest tagged, or with the digest, ref in the repository.
+func (f *fakeRegistry) manifest(repo, ref string) ([]byte, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	raw, ok := f.manifests[repo][ref]
+	return raw, ok
+}
+
+// fail writes a distribution API error.
+func (f *fakeRegistry) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, strings.ToLower(code))
+}
+
+// ServeHTTP implements http.Handler.
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.intercept != nil && f.intercept(w, r) {
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	for _, route := range []struct {
+		sep    string
+		handle func(http.ResponseWriter, *http.Request, string, string)
+	}{
+		{"/manifests/", f.serveManifest},
+		{"/blobs/uploads/", f.serveUpload},
+		{"/blobs/", f.serveBlob},
+		{"/referrers/", f.serveReferrers},
+		{"/tags/", f.serveTags},
+	} {
+		repo, ref, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), route.sep)
+		if ok {
+			route.handle(w, r, repo, ref)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	if r.Method == http.MethodPut {
+		raw, _ := io.ReadAll(r.Body)
+		tag := ref
+		if _, err := digest.Parse(ref); err == nil {
+			tag = ""
+		}
+		dgst := f.put(repo, tag, raw)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	raw, ok := f.manifest(repo, ref)
+	if !ok {
+		f.fail(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		return
+	}
+	w.Header().Set("Content-Type", manifest.GuessMIMEType(raw))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(raw).String())
+	w.Header().Set("Content-Length", fmt.Sprint(len(raw)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(raw)
+	}
+}
+
+func (f *fakeRegistry) serveBlob(w http.ResponseWriter, r *http.Request, _, ref string) {
+	f.mtx.Lock()
+	data, ok := f.blobs[digest.Digest(ref)]
+	f.mtx.Unlock()
+	if !ok {
+		f.fail(w, http.StatusNotFound, "BLOB_UNKNOWN")
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", ref)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		id = uuid.New().String()
+		f.uploads[id] = []byte{}
+	case http.MethodPatch:
+		data, _ := io.ReadAll(r.Body)
+		f.uploads[id] = append(f.uploads[id], data...)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		data = append(f.uploads[id], data...)
+		delete(f.uploads, id)
+		dgst := digest.FromBytes(data)
+		if dgst.String() != r.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[dgst] = data
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+	w.Header().Set("Range", fmt.Sprintf("0-%d", max(len(f.uploads[id])-1, 0)))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeRegistry) serveReferrers(w http.ResponseWriter, _ *http.Request, repo, subject string) {
+	if !f.referrers {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	index := imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{},
+	}
+	for ref, raw := range f.manifests[repo] {
+		var man imgspecv1.Manifest
+		if _, err := digest.Parse(ref); err != nil || json.Unmarshal(raw, &man) != nil {
+			continue
+		}
+		if man.Subject == nil || man.Subject.Digest.String() != subject {
+			continue
+		}
+		index.Manifests = append(index.Manifests, imgspecv1.Descriptor{
+			MediaType:    man.MediaType,
+			ArtifactType: man.ArtifactType,
+			Digest:       digest.FromBytes(raw),
+			Size:         int64(len(raw)),
+		})
+	}
+	w.Header().Set("Content-Type", imgspecv1.MediaTypeImageIndex)
+	_ = json.NewEncoder(w).Encode(index)
+}
+
+func (f *fakeRegistry) serveTags(w http.ResponseWriter, _ *http.Request, repo, _ string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.manifests[repo]; !ok {
+		f.fail(w, http.StatusNotFound, "NAME_UNKNOWN")
+		return
+	}
+	tags := []string{}
+	for ref := range f.manifests[repo] {
+		if _, err := digest.Parse(ref); err != nil {
+			tags = append(tags, ref)
+		}
+	}
+	slices.Sort(tags)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+}
+
+func TestRegistryGet(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.referrers = true
+	var authorization string
+	registry.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.URL.Path == "/token":
+			assert.Equal(t, "repository:repo:pull", r.URL.Query().Get("scope"), "pull access should be requested")
+			user, pass, _ := r.BasicAuth()
+			assert.Equal(t, "user:pass", user+":"+pass, "configured credentials should be presented")
+			_, _ = w.Write([]byte(`{"token":"secret"}`))
+			return true
+		case r.Header.Get("Authorization") == "":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		authorization = r.Header.Get("Authorization")
+		return false
+	}
+
+	named, err := reference.ParseNormalizedNamed(registry.host() + "/repo@" + digest.FromString("subject").String())
+	require.NoError(t, err, "unable to parse reference")
+	sysctx := registry.sysctx()
+	sysctx.DockerAuthConfig = &types.DockerAuthConfig{Username: "user", Password: "pass"}
+	resp, err := registryGet(context.Background(), sysctx, named, "referrers/"+digest.FromString("subject").String(), imgspecv1.MediaTypeImageIndex)
+	require.NoError(t, err, "unable to query registry")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer secret", authorization, "token should be presented")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err, "unable to read response")
+	assert.True(t, bytes.Contains(body, []byte(imgspecv1.MediaTypeImageIndex)), "referrers index should be returned")
+}
@@ -0,0 +1,189 @@
+package imo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"go.podman.io/image/v5/docker/reference"
+	"gopkg.in/yaml.v3"
+)
+
+// Release describes a set of images to be moved together. Registry is the source
+// registry (including the namespace) from where images are pulled and Destination
+// is the default destination (also including the namespace) where images are
+// pushed to. Releases can be written in YAML or JSON, for example:
+//
+//	registry: quay.io/myorg
+//	destination: registry.internal/myorg
+//	images:
+//	- name: app
+//	  previous: v1.0.0
+//	  next: v2.0.0
+//	- name: worker
+//	  next: v1.0.0
+//	  destination: registry.internal/workers/worker
+type Release struct {
+	Registry    string         `json:"registry" yaml:"registry"`
+	Destination string         `json:"destination,omitempty" yaml:"destination,omitempty"`
+	Images      []ReleaseImage `json:"images" yaml:"images"`
+}
+
+// ReleaseImage is an image part of a Release. Previous is the tag the remote side
+// already holds, if empty the whole image is shipped. Next is the tag we want to
+// ship. Destination is the repository where the image is going to be pushed, if
+// empty the image is pushed to Release.Destination under the same name.
+type ReleaseImage struct {
+	Name        string `json:"name" yaml:"name"`
+	Previous    string `json:"previous,omitempty" yaml:"previous,omitempty"`
+	Next        string `json:"next" yaml:"next"`
+	Destination string `json:"destination,omitempty" yaml:"destination,omitempty"`
+}
+
+// LoadRelease reads and validates a release file. The file can be either in YAML
+// or in JSON format.
+func LoadRelease(fpath string) (*Release, error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening release file: %w", err)
+	}
+	defer fp.Close()
+	return ReadRelease(fp)
+}
+
+// ReadRelease reads and validates a release from the provided reader. The content
+// can be either in YAML or in JSON format.
+func ReadRelease(r io.Reader) (*Release, error) {
+	var rel Release
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rel); err != nil {
+		return nil, fmt.Errorf("error parsing release: %w", err)
+	}
+	if err := rel.Validate(); err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+// Validate checks that the release is complete and that all the references it
+// produces are valid. Errors point to the offending image entries.
+func (r *Release) Validate() error {
+	if r.Registry == "" {
+		return fmt.Errorf("release has no registry")
+	}
+	if len(r.Images) == 0 {
+		return fmt.Errorf("release has no images")
+	}
+	errs := []error{}
+	seen := map[string]int{}
+	for i, img := range r.Images {
+		if err := r.validateImage(img); err != nil {
+			errs = append(errs, fmt.Errorf("images[%d] (%s): %w", i, img.Name, err))
+			continue
+		}
+		if prev, ok := seen[img.Name]; ok {
+			errs = append(errs, fmt.Errorf("images[%d] (%s): duplicates images[%d]", i, img.Name, prev))
+			continue
+		}
+		seen[img.Name] = i
+	}
+	return errors.Join(errs...)
+}
+
+// validateImage validates a single image entry of the release.
+func (r *Release) validateImage(img ReleaseImage) error {
+	if img.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if img.Next == "" {
+		return fmt.Errorf("next tag is empty")
+	}
+	if img.Destination == "" && r.Destination == "" {
+		return fmt.Errorf("no destination and release has no default destination")
+	}
+	if img.Destination != "" {
+		named, err := reference.ParseNormalizedNamed(img.Destination)
+		if err != nil {
+			return fmt.Errorf("invalid destination %s: %w", img.Destination, err)
+		}
+		if !reference.IsNameOnly(named) {
+			return fmt.Errorf("destination %s must be a repository", img.Destination)
+		}
+	}
+	refs := []string{r.source(img, img.Next), r.destination(img)}
+	if img.Previous != "" {
+		refs = append(refs, r.source(img, img.Previous))
+	}
+	for _, ref := range refs {
+		if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+			return fmt.Errorf("invalid reference %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// Entries returns the bundle entries for all the images in the release. Images
+// without a previous tag are pulled from scratch.
+func (r *Release) Entries() []BundleEntry {
+	entries := []BundleEntry{}
+	for _, img := range r.Images {
+		base := "scratch"
+		if img.Previous != "" {
+			base = r.source(img, img.Previous)
+		}
+		entries = append(entries, BundleEntry{
+			Name:  img.Name,
+			Base:  base,
+			Final: r.source(img, img.Next),
+		})
+	}
+	return entries
+}
+
+// Destinations returns a map relating each image in the release with the reference
+// to where it must be pushed.
+func (r *Release) Destinations() map[string]string {
+	dsts := map[string]string{}
+	for _, img := range r.Images {
+		dsts[img.Name] = r.destination(img)
+	}
+	return dsts
+}
+
+// source returns the source reference for the provided image and tag.
+func (r *Release) source(img ReleaseImage, tag string) string {
+	return fmt.Sprintf("%s:%s", path.Join(r.Registry, img.Name), tag)
+}
+
+// destination returns the destination reference for the provided image. Images
+// are always pushed using their next tag.
+func (r *Release) destination(img ReleaseImage) string {
+	repo := img.Destination
+	if repo == "" {
+		repo = path.Join(r.Destination, img.Name)
+	}
+	return fmt.Sprintf("%s:%s", repo, img.Next)
+}
+
+// PullRelease pulls the incremental difference for all the images in the release
+// into a single bundle. See PullBundle for details.
+func (inc *Incremental) PullRelease(ctx context.Context, rel *Release) (*Diff, error) {
+	if err := rel.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid release: %w", err)
+	}
+	return inc.PullBundle(ctx, rel.Entries())
+}
+
+// PushRelease pushes a bundle previously pulled with PullRelease. Images are sent
+// to the destinations described in the release. Returns the result of the push
+// for each image, indexed by image name.
+func (inc *Incremental) PushRelease(ctx context.Context, src string, rel *Release) (map[string]*PushResult, error) {
+	if err := rel.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid release: %w", err)
+	}
+	return inc.PushBundle(ctx, src, rel.Destinations())
+}
@@ -0,0 +1,87 @@
+package imo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReleaseYAML(t *testing.T) {
+	rel, err := ReadRelease(strings.NewReader(`
+registry: quay.io/myorg
+destination: registry.internal/myorg
+images:
+- name: app
+  previous: v1.0.0
+  next: v2.0.0
+- name: worker
+  next: v1.0.0
+  destination: registry.internal/workers/worker
+`))
+	require.NoError(t, err, "unable to read release")
+	assert.Equal(t, []BundleEntry{
+		{Name: "app", Base: "quay.io/myorg/app:v1.0.0", Final: "quay.io/myorg/app:v2.0.0"},
+		{Name: "worker", Base: "scratch", Final: "quay.io/myorg/worker:v1.0.0"},
+	}, rel.Entries())
+	assert.Equal(t, map[string]string{
+		"app":    "registry.internal/myorg/app:v2.0.0",
+		"worker": "registry.internal/workers/worker:v1.0.0",
+	}, rel.Destinations())
+}
+
+func TestReadReleaseJSON(t *testing.T) {
+	rel, err := ReadRelease(strings.NewReader(`{
+		"registry": "quay.io/myorg",
+		"destination": "registry.internal/myorg",
+		"images": [{"name": "app", "previous": "v1", "next": "v2"}]
+	}`))
+	require.NoError(t, err, "unable to read release")
+	assert.Len(t, rel.Images, 1)
+}
+
+func TestReadReleaseInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		errmsg  string
+	}{
+		{
+			name:    "unknown field",
+			content: "registry: quay.io\nimages:\n- name: app\n  nxt: v1\n",
+			errmsg:  "field nxt not found",
+		},
+		{
+			name:    "missing next",
+			content: "registry: quay.io\ndestination: local\nimages:\n- name: app\n- name: db\n  next: v1\n",
+			errmsg:  "images[0] (app): next tag is empty",
+		},
+		{
+			name:    "duplicated image",
+			content: "registry: quay.io\ndestination: local\nimages:\n- name: app\n  next: v1\n- name: app\n  next: v2\n",
+			errmsg:  "images[1] (app): duplicates images[0]",
+		},
+		{
+			name:    "invalid reference",
+			content: "registry: quay.io\ndestination: local\nimages:\n- name: App\n  next: v1\n",
+			errmsg:  "images[0] (App): invalid reference",
+		},
+		{
+			name:    "destination with tag",
+			content: "registry: quay.io\nimages:\n- name: app\n  next: v1\n  destination: local/app:v1\n",
+			errmsg:  "images[0] (app): destination local/app:v1 must be a repository",
+		},
+		{
+			name:    "no destination",
+			content: "registry: quay.io\nimages:\n- name: app\n  next: v1\n",
+			errmsg:  "images[0] (app): no destination",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRelease(strings.NewReader(tt.content))
+			require.Error(t, err, "release should be invalid")
+			assert.Contains(t, err.Error(), tt.errmsg)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package imo
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// PushResult holds information about an image pushed to a registry. Reference is
+// the destination as provided by the caller while PinnedReference points to the
+// same image by digest. Digest is the digest of the top level manifest, this is
+// the digest deployments should be pinned to. When a manifest list is pushed the
+// ManifestListDigest is also set and Instances lists the pushed children. Aliases
+// lists other references the same manifest has been pushed to.
+type PushResult struct {
+	Reference          string
+	PinnedReference    string
+	Aliases            []string
+	Digest             digest.Digest
+	ManifestListDigest digest.Digest
+	Instances          []PushedInstance
+}
+
+// PushedInstance is an image, part of a manifest list, that has been pushed.
+type PushedInstance struct {
+	Digest    digest.Digest
+	MediaType string
+	Platform  *imgspecv1.Platform
+}
+
+// newPushResult returns a PushResult for the provided manifest pushed to dstref.
+func newPushResult(dstref types.ImageReference, rawman []byte) (*PushResult, error) {
+	dgst, err := manifest.Digest(rawman)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating manifest digest: %w", err)
+	}
+	result := &PushResult{Digest: dgst}
+	if named := dstref.DockerReference(); named != nil {
+		result.Reference = named.String()
+		pinned, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+		if err != nil {
+			return nil, fmt.Errorf("error pinning reference: %w", err)
+		}
+		result.PinnedReference = pinned.String()
+	}
+	mime := manifest.GuessMIMEType(rawman)
+	if !manifest.MIMETypeIsMultiImage(mime) {
+		return result, nil
+	}
+	list, err := manifest.ListFromBlob(rawman, mime)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest list: %w", err)
+	}
+	result.ManifestListDigest = dgst
+	for _, instance := range list.Instances() {
+		info, err := list.Instance(instance)
+		if err != nil {
+			return nil, fmt.Errorf("error reading instance %s: %w", instance, err)
+		}
+		result.Instances = append(result.Instances, PushedInstance{
+			Digest:    info.Digest,
+			MediaType: info.MediaType,
+			Platform:  info.ReadOnly.Platform,
+		})
+	}
+	return result, nil
+}
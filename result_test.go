@@ -0,0 +1,55 @@
+package imo
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+)
+
+func Test_newPushResult(t *testing.T) {
+	dstref, err := alltransports.ParseImageName("docker://registry.internal/myorg/app:v2")
+	require.NoError(t, err, "unable to parse destination")
+
+	man, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 6},
+		Layers:    []imgspecv1.Descriptor{},
+	})
+	require.NoError(t, err, "unable to marshal manifest")
+	result, err := newPushResult(dstref, man)
+	require.NoError(t, err, "unable to create result for manifest")
+	assert.Equal(t, digest.FromBytes(man), result.Digest)
+	assert.Empty(t, result.ManifestListDigest)
+	assert.Empty(t, result.Instances)
+	assert.Equal(t, "registry.internal/myorg/app:v2", result.Reference)
+	assert.Equal(t, "registry.internal/myorg/app@"+digest.FromBytes(man).String(), result.PinnedReference)
+
+	platform := &imgspecv1.Platform{Architecture: "arm64", OS: "linux"}
+	list, err := json.Marshal(imgspecv1.Index{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{
+				MediaType: imgspecv1.MediaTypeImageManifest,
+				Digest:    digest.FromBytes(man),
+				Size:      int64(len(man)),
+				Platform:  platform,
+			},
+		},
+	})
+	require.NoError(t, err, "unable to marshal manifest list")
+	result, err = newPushResult(dstref, list)
+	require.NoError(t, err, "unable to create result for manifest list")
+	assert.Equal(t, digest.FromBytes(list), result.Digest)
+	assert.Equal(t, digest.FromBytes(list), result.ManifestListDigest)
+	require.Len(t, result.Instances, 1)
+	assert.Equal(t, digest.FromBytes(man), result.Instances[0].Digest)
+	assert.Equal(t, platform, result.Instances[0].Platform)
+}
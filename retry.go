@@ -0,0 +1,184 @@
+package imo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"go.podman.io/image/v5/docker"
+)
+
+// RetryPolicy determines how registry operations are retried. Attempts is the total
+// number of attempts, values lower than two disable retries. Backoff is the delay
+// before the first retry, the delay doubles on each subsequent attempt but never
+// goes beyond MaxBackoff (if set). Retryable decides if an error is worth retrying,
+// if nil IsRetryable is used.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Retryable  func(error) bool
+}
+
+// do runs fn until it succeeds, the attempts are exhausted, a non retryable error
+// is returned or the context is done. Retries are reported to the report writer.
+func (p RetryPolicy) do(ctx context.Context, report io.Writer, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	delay := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !retryable(err) {
+			return err
+		}
+		fmt.Fprintf(report, "attempt %d of %d failed, retrying in %s: %v\n", attempt, p.Attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+}
+
+// RateLimitPolicy determines how operations rejected because the registry is rate
+// limiting us (HTTP 429) are retried. Attempts is the total number of attempts,
+// values lower than two disable the backoff. Backoff is the wait before the first
+// retry, it doubles on each subsequent attempt but never goes beyond MaxBackoff (if
+// set). If the registry tells how long to wait (Retry-After) the wait is at least
+// that long, MaxBackoff still applies. Retry-After is read from the requests imo
+// sends on its own (e.g. to the OCI referrers API), requests sent through c/image
+// are first retried by c/image itself, honoring Retry-After, and reach this policy
+// without it.
+type RateLimitPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// RateLimitError is returned when a registry rejects a request because of rate
+// limiting. RetryAfter is the wait requested by the registry, zero if the registry
+// did not tell.
+type RateLimitError struct {
+	Registry   string
+	RetryAfter time.Duration
+}
+
+// Error returns the error message.
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("too many requests to %s", e.Registry)
+	}
+	return fmt.Sprintf("too many requests to %s, retry after %s", e.Registry, e.RetryAfter)
+}
+
+// do runs fn until it succeeds, the attempts are exhausted, an error other than
+// a rate limit one is returned or the context is done. Waits are reported to the
+// report writer and made using the provided clock.
+func (p RateLimitPolicy) do(ctx context.Context, report io.Writer, clock clock, fn func() error) error {
+	delay := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !IsRateLimited(err) {
+			return err
+		}
+		wait := delay
+		var rlerr *RateLimitError
+		if errors.As(err, &rlerr) && rlerr.RetryAfter > wait {
+			wait = rlerr.RetryAfter
+		}
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+		fmt.Fprintf(report, "rate limited by registry (attempt %d of %d), waiting %s: %v\n", attempt, p.Attempts, wait, err)
+		if serr := clock.Sleep(ctx, wait); serr != nil {
+			return errors.Join(err, serr)
+		}
+		delay *= 2
+		if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+}
+
+// parseRetryAfter returns the wait requested by the Retry-After header of the
+// response, expressed either in seconds or as a date. Returns zero if the header
+// is absent or invalid.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	after := resp.Header.Get("Retry-After")
+	if after == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(after); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(after); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// IsRateLimited returns true if the error has been caused by the registry rate
+// limiting our requests.
+func IsRateLimited(err error) bool {
+	var rlerr *RateLimitError
+	if errors.Is(err, docker.ErrTooManyRequests) || errors.As(err, &rlerr) {
+		return true
+	}
+	var statuserr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statuserr) {
+		return statuserr.StatusCode == http.StatusTooManyRequests
+	}
+	var codeerr errcode.Error
+	if errors.As(err, &codeerr) {
+		return codeerr.Code == errcode.ErrorCodeTooManyRequests
+	}
+	return false
+}
+
+// IsRetryable returns true if the error is likely to be transient. Timeouts, reset
+// or unexpectedly terminated connections, rate limits and server side (5xx) errors
+// are considered transient. Other network errors (e.g. unknown hosts, refused
+// connections or failed TLS verifications) usually point to a misconfiguration
+// and are not retried.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsRateLimited(err) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var statuserr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statuserr) {
+		return statuserr.StatusCode >= 500
+	}
+	var codeerr errcode.Error
+	if errors.As(err, &codeerr) {
+		return codeerr.Code == errcode.ErrorCodeUnavailable
+	}
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Timeout()
+}
+
+// withRetry runs fn according to the configured retry policy. Each attempt backs
+// off, according to the rate limit policy, while the registry is rate limiting us.
+func (inc *Incremental) withRetry(ctx context.Context, fn func() error) error {
+	return inc.retry.do(ctx, inc.report, func() error {
+		return inc.rateLimit.do(ctx, inc.report, inc.clock, fn)
+	})
+}
@@ -0,0 +1,202 @@
+package imo
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		policy   RetryPolicy
+		errs     []error
+		calls    int
+		succeeds bool
+	}{
+		{
+			name:   "no retries by default",
+			policy: RetryPolicy{},
+			errs:   []error{io.ErrUnexpectedEOF, nil},
+			calls:  1,
+		},
+		{
+			name:     "retries transient errors",
+			policy:   RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			errs:     []error{io.ErrUnexpectedEOF, docker.ErrTooManyRequests, nil},
+			calls:    3,
+			succeeds: true,
+		},
+		{
+			name:   "gives up after attempts",
+			policy: RetryPolicy{Attempts: 2, Backoff: time.Millisecond},
+			errs:   []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, nil},
+			calls:  2,
+		},
+		{
+			name:   "does not retry permanent errors",
+			policy: RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			errs:   []error{errors.New("manifest unknown"), nil},
+			calls:  1,
+		},
+		{
+			name: "custom retryable",
+			policy: RetryPolicy{
+				Attempts:  3,
+				Backoff:   time.Millisecond,
+				Retryable: func(error) bool { return true },
+			},
+			errs:     []error{errors.New("manifest unknown"), nil},
+			calls:    2,
+			succeeds: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			report := bytes.NewBuffer(nil)
+			err := tt.policy.do(context.Background(), report, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			assert.Equal(t, tt.calls, calls, "unexpected number of calls")
+			assert.Equal(t, tt.succeeds, err == nil, "unexpected result: %v", err)
+			assert.Equal(t, tt.calls > 1, report.Len() > 0, "retries should be reported")
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), retryable: true},
+		{err: docker.ErrTooManyRequests, retryable: true},
+		{err: &RateLimitError{Registry: "quay.io"}, retryable: true},
+		{err: docker.UnexpectedHTTPStatusError{StatusCode: 502}, retryable: true},
+		{err: docker.UnexpectedHTTPStatusError{StatusCode: 404}, retryable: false},
+		{err: context.Canceled, retryable: false},
+		{err: &net.DNSError{Err: "no such host", Name: "registry.example.com", IsNotFound: true}, retryable: false},
+		{err: &net.DNSError{Err: "i/o timeout", Name: "registry.example.com", IsTimeout: true}, retryable: true},
+		{err: fmt.Errorf("dial: %w", syscall.ECONNRESET), retryable: true},
+		{err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED), retryable: false},
+		{err: &tls.CertificateVerificationError{Err: errors.New("unknown authority")}, retryable: false},
+		{err: errors.New("unknown"), retryable: false},
+	} {
+		assert.Equal(t, tt.retryable, IsRetryable(tt.err), "unexpected result for %v", tt.err)
+	}
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	policy := RateLimitPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	calls := 0
+	report := bytes.NewBuffer(nil)
+	clock := &fakeClock{now: time.Now()}
+	err := policy.do(context.Background(), report, clock, func() error {
+		calls++
+		if calls == 1 {
+			return &RateLimitError{Registry: "quay.io", RetryAfter: 20 * time.Millisecond}
+		}
+		if calls == 2 {
+			return &RateLimitError{Registry: "quay.io", RetryAfter: time.Hour}
+		}
+		return nil
+	})
+	require.NoError(t, err, "rate limited operation should succeed")
+	assert.Equal(t, 3, calls, "unexpected number of calls")
+	assert.Equal(t, 70*time.Millisecond, clock.Slept(), "retry after should be honored and capped by max backoff")
+	assert.Contains(t, report.String(), "rate limited by registry", "waits should be reported")
+
+	calls = 0
+	err = policy.do(context.Background(), io.Discard, clock, func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, 1, calls, "errors other than rate limits should not be retried")
+
+	calls = 0
+	err = policy.do(context.Background(), io.Discard, clock, func() error {
+		calls++
+		return docker.UnexpectedHTTPStatusError{StatusCode: http.StatusTooManyRequests}
+	})
+	assert.True(t, IsRateLimited(err), "last error should be returned")
+	assert.Equal(t, 3, calls, "should give up after attempts")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{header: "", min: 0, max: 0},
+		{header: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{header: "invalid", min: 0, max: 0},
+		{header: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute},
+		{header: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		after := parseRetryAfter(resp)
+		assert.GreaterOrEqual(t, after, tt.min, "unexpected wait for %q", tt.header)
+		assert.LessOrEqual(t, after, tt.max, "unexpected wait for %q", tt.header)
+	}
+}
+
+func TestPullRetryAfter(t *testing.T) {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	image := layout.image(t, "amd64", "base", "top")
+	artifact := layout.sbom(t, image, "sbom")
+	registry := newFakeRegistry(t)
+	registry.referrers = true
+	registry.load(t, dir, "repo", "v1", image)
+	registry.load(t, dir, "repo", "", artifact)
+	var limited atomic.Bool
+	registry.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.Contains(r.URL.Path, "/referrers/") || limited.Swap(true) {
+			return false
+		}
+		w.Header().Set("Retry-After", "90")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	report := bytes.NewBuffer(nil)
+	inc := New(
+		WithTempDir(t.TempDir()),
+		WithInsecurePull(),
+		WithReferrers(),
+		WithReporterWriter(report),
+		WithRateLimitPolicy(RateLimitPolicy{Attempts: 2, Backoff: time.Second}),
+	)
+	inc.clock = clock
+	diff, err := inc.Pull(context.Background(), "scratch", registry.host()+"/repo:v1")
+	require.NoError(t, err, "rate limited pull should succeed")
+	defer diff.Close()
+	assert.True(t, limited.Load(), "registry should have rate limited the pull")
+	assert.Equal(t, 90*time.Second, clock.Slept(), "retry after should be honored")
+	assert.Contains(t, report.String(), "retry after 1m30s", "wait should be reported")
+	require.Len(t, diff.Metadata.Images, 1)
+	require.Len(t, diff.Metadata.Images[0].Referrers, 1, "referrer should be pulled after the wait")
+	assert.Equal(t, artifact.Digest, diff.Metadata.Images[0].Referrers[0].Manifest.Digest)
+}
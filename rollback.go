@@ -0,0 +1,59 @@
+package imo
+
+import (
+	"context"
+	"fmt"
+
+	"go.podman.io/image/v5/types"
+)
+
+// PullWithRollback pulls, in a single pass, the incremental difference between base
+// and final (as Pull does) and the rollback difference between final and base. The
+// rollback archive holds the layers of the base image not present in the final
+// image so the base can be restored on the other side even if it is no longer in
+// the destination registry. Both references are pinned and their manifests are
+// fetched only once, being used for both differences. Returns the forward and the
+// rollback Diffs, the caller is responsible for closing both.
+func (inc *Incremental) PullWithRollback(ctx context.Context, base, final string) (*Diff, *Diff, error) {
+	if base == "scratch" {
+		return nil, nil, fmt.Errorf("a rollback requires a base image")
+	}
+	basectx := &types.SystemContext{DockerAuthConfig: inc.auths.BaseAuth}
+	baseref, err := inc.pin(ctx, basectx, base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error pinning base reference: %w", err)
+	}
+	finalref, err := inc.pin(ctx, inc.finalSysctx(), final)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error pinning final reference: %w", err)
+	}
+	baseidx := NewManifestsIndex(basectx)
+	finalidx := NewManifestsIndex(inc.finalSysctx())
+	if err := inc.withRetry(ctx, func() error {
+		if err := baseidx.FetchManifests(ctx, baseref); err != nil {
+			return fmt.Errorf("error fetching base manifests: %w", err)
+		}
+		if err := finalidx.FetchManifests(ctx, finalref); err != nil {
+			return fmt.Errorf("error fetching final manifests: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	basename := baseref.DockerReference().String()
+	finalname := finalref.DockerReference().String()
+	forward, err := inc.pullFromIndex(
+		ctx, baseidx, finalref, inc.finalSysctx(), ImageMetadata{Base: basename, Final: finalname},
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error pulling forward difference: %w", err)
+	}
+	rollback, err := inc.pullFromIndex(
+		ctx, finalidx, baseref, basectx, ImageMetadata{Base: finalname, Final: basename},
+	)
+	if err != nil {
+		forward.Close()
+		return nil, nil, fmt.Errorf("error pulling rollback difference: %w", err)
+	}
+	return forward, rollback, nil
+}
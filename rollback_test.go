@@ -0,0 +1,50 @@
+package imo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestPullFromIndexBothWays(t *testing.T) {
+	ctx := context.Background()
+	basedir, finaldir := t.TempDir(), t.TempDir()
+	baselayout := newTestLayout(t, basedir)
+	baselayout.tag(t, "", baselayout.image(t, "amd64", "shared", "old"))
+	finallayout := newTestLayout(t, finaldir)
+	finallayout.tag(t, "", finallayout.image(t, "amd64", "shared", "new"))
+
+	indexes := []*ManifestsIndex{}
+	refs := []types.ImageReference{}
+	for _, dir := range []string{basedir, finaldir} {
+		ref, err := alltransports.ParseImageName("oci:" + dir)
+		require.NoError(t, err)
+		index := NewManifestsIndex(&types.SystemContext{})
+		require.NoError(t, index.FetchManifests(ctx, ref), "unable to fetch manifests")
+		indexes = append(indexes, index)
+		refs = append(refs, ref)
+	}
+
+	inc := New()
+	forward, err := inc.pullFromIndex(ctx, indexes[0], refs[1], &types.SystemContext{}, ImageMetadata{Final: "v2"})
+	require.NoError(t, err, "unable to pull forward difference")
+	defer forward.Close()
+	rollback, err := inc.pullFromIndex(ctx, indexes[1], refs[0], &types.SystemContext{}, ImageMetadata{Final: "v1"})
+	require.NoError(t, err, "unable to pull rollback difference")
+	defer rollback.Close()
+
+	shared := []digest.Digest{digest.FromString("shared")}
+	assert.Equal(t, shared, forward.Metadata.Images[0].Omitted)
+	assert.Equal(t, shared, rollback.Metadata.Images[0].Omitted)
+	assert.Equal(t, "v1", rollback.Metadata.Images[0].Final)
+}
+
+func TestPullWithRollbackScratch(t *testing.T) {
+	_, _, err := New().PullWithRollback(context.Background(), "scratch", "registry.example.com/app:v2")
+	assert.Error(t, err, "rollback from scratch should fail")
+}
@@ -0,0 +1,413 @@
+package imo
+
+import (
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/types"
+)
+
+// errServerBusy is returned when all the diff computation slots are taken.
+var errServerBusy = errors.New("too many diffs being computed")
+
+// errServerClosed is returned for requests arriving after the Server is closed.
+var errServerClosed = errors.New("server closed")
+
+// ServerOption is a functional option for the Server type.
+type ServerOption func(*Server)
+
+// WithServerTokens sets the bearer tokens accepted by the Server. Requests without
+// one of the tokens in their Authorization header are refused. At least one token
+// must be provided unless WithServerInsecureNoAuth is used.
+func WithServerTokens(tokens ...string) ServerOption {
+	return func(s *Server) {
+		for _, token := range tokens {
+			s.tokens = append(s.tokens, []byte(token))
+		}
+	}
+}
+
+// WithServerInsecureNoAuth makes the Server accept requests without tokens. As
+// diffs are computed with the credentials of the Incremental anyone reaching the
+// Server can read the images they give access to, this should only be used when
+// access to the Server is restricted by other means.
+func WithServerInsecureNoAuth() ServerOption {
+	return func(s *Server) {
+		s.noauth = true
+	}
+}
+
+// WithServerConcurrency sets how many diffs the Server computes at the same time,
+// it must be at least one. Requests for diffs not yet computed are refused, with
+// a 503 status, while the limit is reached. Requests for diffs being computed or
+// cached don't count towards the limit. By default two diffs are computed at the
+// same time.
+func WithServerConcurrency(max int) ServerOption {
+	return func(s *Server) {
+		s.concurrency = max
+	}
+}
+
+// WithServerTimeout sets how long the Server spends computing a diff before giving
+// up. By default diffs are given an hour.
+func WithServerTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// WithServerCacheSize sets how many computed diffs the Server keeps on disk, the
+// least recently requested diffs are removed first. By default sixteen diffs are
+// kept, zero disables the cache.
+func WithServerCacheSize(size int) ServerOption {
+	return func(s *Server) {
+		s.size = size
+	}
+}
+
+// serverEntry is a diff computed, or being computed, by the Server. Once done is
+// closed either err is set or the archive is stored in path. Entries with requests
+// waiting for them are not evicted. Cancel aborts the computation.
+type serverEntry struct {
+	key     string
+	path    string
+	created time.Time
+	err     error
+	done    chan struct{}
+	cancel  context.CancelFunc
+	elem    *list.Element
+	waiting int
+}
+
+// Server is an http.Handler serving incremental differences on demand. Diffs are
+// requested with "GET /diff?base=<image>&final=<image>" and are returned as the
+// oci-archive produced by Pull, using the options of the provided Incremental. Both
+// images are resolved to digests on each request so moving tags are honored and the
+// pinned references are returned in the Imo-Base and Imo-Final headers. Computed
+// diffs are cached on disk, by the digests of both images, and concurrent requests
+// for the same diff share the same computation, which is aborted if all of them go
+// away. Cached diffs support range requests so interrupted downloads can be resumed.
+type Server struct {
+	inc         *Incremental
+	tokens      [][]byte
+	noauth      bool
+	concurrency int
+	timeout     time.Duration
+	slots       chan struct{}
+	size        int
+	dir         string
+	mux         *http.ServeMux
+	mtx         sync.Mutex
+	closed      bool
+	entries     map[string]*serverEntry
+	recent      *list.List
+	resolve     func(ctx context.Context, sysctx *types.SystemContext, ref string) (string, error)
+	pull        func(ctx context.Context, base, final string) (*Diff, error)
+}
+
+// NewServer returns a Server computing diffs with the provided Incremental. Tokens
+// (see WithServerTokens) are required unless WithServerInsecureNoAuth is used. Diffs
+// are cached in a directory created inside the Incremental temporary directory,
+// Close removes it.
+func NewServer(inc *Incremental, opts ...ServerOption) (*Server, error) {
+	s := &Server{
+		inc:         inc,
+		concurrency: 2,
+		timeout:     time.Hour,
+		size:        16,
+		mux:         http.NewServeMux(),
+		entries:     map[string]*serverEntry{},
+		recent:      list.New(),
+		pull:        inc.Pull,
+		resolve: func(ctx context.Context, sysctx *types.SystemContext, ref string) (string, error) {
+			pinned, err := inc.pin(ctx, sysctx, ref)
+			if err != nil {
+				return "", err
+			}
+			return pinned.DockerReference().String(), nil
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if len(s.tokens) == 0 && !s.noauth {
+		return nil, fmt.Errorf("server requires tokens unless authentication is explicitly disabled")
+	}
+	if s.concurrency < 1 {
+		return nil, fmt.Errorf("invalid server concurrency %d, must be at least one", s.concurrency)
+	}
+	s.slots = make(chan struct{}, s.concurrency)
+	dir, err := os.MkdirTemp(inc.tmpdir, "imo-serve-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	s.dir = dir
+	s.mux.HandleFunc("GET /diff", s.diff)
+	return s, nil
+}
+
+// ServeHTTP authenticates the request and serves it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	closed := s.closed
+	s.mtx.Unlock()
+	if closed {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imo"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close removes all the cached diffs. Diffs being computed are removed once done.
+// Requests arriving after Close are refused with 503 (service unavailable).
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	for key, entry := range s.entries {
+		if entry.elem != nil {
+			s.recent.Remove(entry.elem)
+			delete(s.entries, key)
+		}
+	}
+	s.size = 0
+	return os.RemoveAll(s.dir)
+}
+
+// authorized returns true if the request carries one of the accepted tokens or if
+// authentication has been disabled.
+func (s *Server) authorized(r *http.Request) bool {
+	return s.noauth || bearerAuthorized(r, s.tokens)
+}
+
+// bearerAuthorized returns true if the request carries one of the tokens in its
+// Authorization header.
+func bearerAuthorized(r *http.Request, tokens [][]byte) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, accepted := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), accepted) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// diff serves the diff between the base and final images in the request query.
+func (s *Server) diff(w http.ResponseWriter, r *http.Request) {
+	base, final := r.URL.Query().Get("base"), r.URL.Query().Get("final")
+	if base == "" || final == "" {
+		http.Error(w, "base and final images are required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if base != "scratch" {
+		sysctx := &types.SystemContext{DockerAuthConfig: s.inc.auths.BaseAuth}
+		if base, err = s.resolve(r.Context(), sysctx, base); err != nil {
+			s.fail(w, fmt.Errorf("error resolving base image: %w", err), http.StatusBadGateway)
+			return
+		}
+	}
+	if final, err = s.resolve(r.Context(), s.inc.finalSysctx(), final); err != nil {
+		s.fail(w, fmt.Errorf("error resolving final image: %w", err), http.StatusBadGateway)
+		return
+	}
+	entry, fp, err := s.lookup(r.Context(), base, final)
+	if errors.Is(err, errServerBusy) {
+		w.Header().Set("Retry-After", "30")
+		s.fail(w, err, http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, errServerClosed) {
+		s.fail(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		s.fail(w, err, http.StatusBadGateway)
+		return
+	}
+	defer fp.Close()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="diff.tar"`)
+	w.Header().Set("ETag", fmt.Sprintf("%q", entry.key))
+	w.Header().Set("Imo-Base", base)
+	w.Header().Set("Imo-Final", final)
+	http.ServeContent(w, r, "", entry.created, fp)
+}
+
+// fail reports the error and returns the provided status to the client. Errors may
+// hold details about the registries (e.g. hosts or credentials problems) so they
+// are not sent to the client.
+func (s *Server) fail(w http.ResponseWriter, err error, status int) {
+	fmt.Fprintf(s.inc.report, "error serving diff: %v\n", err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// lookup returns the diff between base and final, both pinned by digest, and an
+// open file for its archive. Diffs not yet cached are computed, waiting for the
+// computation until the context is done. Returns errServerBusy if the diff needs
+// to be computed and the concurrency limit has been reached.
+func (s *Server) lookup(ctx context.Context, base, final string) (*serverEntry, *os.File, error) {
+	key := digest.FromString(base + "\n" + final).Encoded()
+	for {
+		entry, err := s.entry(key, base, final)
+		if err != nil {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			s.release(entry)
+			return nil, nil, ctx.Err()
+		case <-entry.done:
+		}
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			s.release(entry)
+			return nil, nil, errServerClosed
+		}
+		if entry.err != nil {
+			s.mtx.Unlock()
+			s.release(entry)
+			return nil, nil, entry.err
+		}
+		// the diff may have been evicted in the meantime, in which case it is
+		// looked up, and computed, again.
+		if s.entries[key] != entry {
+			s.mtx.Unlock()
+			continue
+		}
+		fp, err := os.Open(entry.path)
+		s.mtx.Unlock()
+		s.release(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening diff: %w", err)
+		}
+		return entry, fp, nil
+	}
+}
+
+// release marks the entry as no longer waited by a request and evicts the diffs
+// not fitting the cache. Computations no longer waited by any request are aborted
+// and their entries dropped, later requests start a new computation.
+func (s *Server) release(entry *serverEntry) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entry.waiting--
+	if entry.waiting == 0 && entry.elem == nil {
+		entry.cancel()
+		if s.entries[entry.key] == entry {
+			delete(s.entries, entry.key)
+		}
+	}
+	s.evict()
+}
+
+// entry returns the entry for the key, starting its computation if needed. Cached
+// entries are marked as the most recently used. The entry is kept until released.
+func (s *Server) entry(key, base, final string) (*serverEntry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return nil, errServerClosed
+	}
+	if entry, ok := s.entries[key]; ok {
+		if entry.elem != nil {
+			s.recent.MoveToFront(entry.elem)
+		}
+		entry.waiting++
+		return entry, nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return nil, errServerBusy
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	entry := &serverEntry{key: key, done: make(chan struct{}), cancel: cancel, waiting: 1}
+	entry.path = path.Join(s.dir, fmt.Sprintf("%s.tar", entry.key))
+	s.entries[key] = entry
+	go s.compute(ctx, entry, base, final)
+	return entry, nil
+}
+
+// compute pulls the diff for the entry into the cache directory. The computation
+// is aborted once the context is done, either because it timed out or because no
+// request waits for it anymore. Failed entries are dropped so they are computed
+// again on the next request.
+func (s *Server) compute(ctx context.Context, entry *serverEntry, base, final string) {
+	defer func() { <-s.slots }()
+	defer close(entry.done)
+	defer entry.cancel()
+	entry.err = s.store(ctx, entry, base, final)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if entry.err != nil || s.closed || s.entries[entry.key] != entry {
+		os.Remove(entry.path)
+		if s.entries[entry.key] == entry {
+			delete(s.entries, entry.key)
+		}
+		return
+	}
+	entry.elem = s.recent.PushFront(entry)
+	s.evict()
+}
+
+// store pulls the diff between base and final and moves its archive into the entry
+// path. Archives that can't be moved (e.g. they live in another file system) are
+// copied instead.
+func (s *Server) store(ctx context.Context, entry *serverEntry, base, final string) error {
+	fmt.Fprintf(s.inc.report, "computing diff from %s to %s\n", base, final)
+	diff, err := s.pull(ctx, base, final)
+	if err != nil {
+		return fmt.Errorf("error computing diff: %w", err)
+	}
+	defer diff.Close()
+	if archive, ok := diff.ReadCloser.(RemoveOnClose); ok {
+		if err := os.Rename(archive.path, entry.path); err == nil {
+			entry.created = time.Now()
+			return nil
+		}
+	}
+	fp, err := os.Create(entry.path)
+	if err != nil {
+		return fmt.Errorf("error creating diff file: %w", err)
+	}
+	defer fp.Close()
+	if _, err := io.Copy(fp, diff); err != nil {
+		return fmt.Errorf("error writing diff file: %w", err)
+	}
+	entry.created = time.Now()
+	return nil
+}
+
+// evict removes the least recently used diffs, not waited by any request, until the
+// cache fits its size. Files being served are kept open, so removing them does not
+// affect the responses. Must be called with the lock held.
+func (s *Server) evict() {
+	for elem := s.recent.Back(); elem != nil && s.recent.Len() > s.size; {
+		prev := elem.Prev()
+		if entry := elem.Value.(*serverEntry); entry.waiting == 0 {
+			s.recent.Remove(elem)
+			delete(s.entries, entry.key)
+			os.Remove(entry.path)
+		}
+		elem = prev
+	}
+}
@@ -0,0 +1,255 @@
+package imo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+// testServer returns a Server resolving images by appending "@pinned" to them and
+// pulling diffs whose content names both images. Pulls wait for the gate channel,
+// if not nil, or until their context is done and are counted in pulls.
+func testServer(t *testing.T, pulls *atomic.Int32, gate chan struct{}, opts ...ServerOption) *Server {
+	server, err := NewServer(New(WithTempDir(t.TempDir())), opts...)
+	require.NoError(t, err, "unable to create server")
+	t.Cleanup(func() { server.Close() })
+	server.resolve = func(ctx context.Context, sysctx *types.SystemContext, ref string) (string, error) {
+		if strings.Contains(ref, "missing") {
+			return "", fmt.Errorf("manifest unknown")
+		}
+		return ref + "@pinned", nil
+	}
+	server.pull = func(ctx context.Context, base, final string) (*Diff, error) {
+		pulls.Add(1)
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		md := Metadata{Images: []ImageMetadata{{Base: base, Final: final}}}
+		content := io.NopCloser(strings.NewReader(base + " " + final))
+		return &Diff{ReadCloser: content, Metadata: md}, nil
+	}
+	return server
+}
+
+// getDiff requests the diff between base and final, using the provided token if
+// not empty.
+func getDiff(t *testing.T, handler http.Handler, base, final, token string) *httptest.ResponseRecorder {
+	return getDiffContext(context.Background(), t, handler, base, final, token)
+}
+
+// getDiffContext is getDiff with a context for the request.
+func getDiffContext(ctx context.Context, t *testing.T, handler http.Handler, base, final, token string) *httptest.ResponseRecorder {
+	query := url.Values{"base": {base}, "final": {final}}
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/diff?"+query.Encode(), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerDiff(t *testing.T) {
+	var pulls atomic.Int32
+	server := testServer(t, &pulls, nil, WithServerTokens("secret"))
+
+	rec := getDiff(t, server, "app:v1", "app:v2", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "requests without token should be refused")
+	rec = getDiff(t, server, "app:v1", "app:v2", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "requests with wrong token should be refused")
+	rec = getDiff(t, server, "", "app:v2", "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "base is required")
+	rec = getDiff(t, server, "app:v1", "missing:v2", "secret")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "unresolvable images should fail")
+	assert.NotContains(t, rec.Body.String(), "manifest unknown", "errors should not be sent to clients")
+
+	rec = getDiff(t, server, "app:v1", "app:v2", "secret")
+	require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	assert.Equal(t, "app:v1@pinned app:v2@pinned", rec.Body.String())
+	assert.Equal(t, "app:v1@pinned", rec.Header().Get("Imo-Base"))
+	assert.Equal(t, "app:v2@pinned", rec.Header().Get("Imo-Final"))
+	assert.Equal(t, "application/x-tar", rec.Header().Get("Content-Type"))
+
+	rec = getDiff(t, server, "app:v1", "app:v2", "secret")
+	require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	assert.Equal(t, int32(1), pulls.Load(), "cached diff should be served")
+
+	rec = getDiff(t, server, "scratch", "app:v2", "secret")
+	require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	assert.Equal(t, "scratch app:v2@pinned", rec.Body.String(), "scratch should not be resolved")
+
+	query := url.Values{"base": {"app:v1"}, "final": {"app:v2"}}
+	req := httptest.NewRequest(http.MethodGet, "/diff?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Range", "bytes=14-")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "range requests should be supported")
+	assert.Equal(t, "app:v2@pinned", rec.Body.String())
+}
+
+func TestServerCache(t *testing.T) {
+	var pulls atomic.Int32
+	server := testServer(t, &pulls, nil, WithServerInsecureNoAuth(), WithServerCacheSize(1))
+	for _, final := range []string{"app:v2", "app:v3", "app:v2"} {
+		rec := getDiff(t, server, "app:v1", final, "")
+		require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	}
+	assert.Equal(t, int32(3), pulls.Load(), "evicted diff should be computed again")
+	files, err := os.ReadDir(server.dir)
+	require.NoError(t, err, "unable to read cache directory")
+	assert.Len(t, files, 1, "only one diff should be kept")
+
+	server = testServer(t, &pulls, nil, WithServerInsecureNoAuth(), WithServerCacheSize(0))
+	rec := getDiff(t, server, "app:v1", "app:v2", "")
+	require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	assert.Equal(t, "app:v1@pinned app:v2@pinned", rec.Body.String(), "diffs should be served without cache")
+	files, err = os.ReadDir(server.dir)
+	require.NoError(t, err, "unable to read cache directory")
+	assert.Empty(t, files, "diffs should not be kept without cache")
+}
+
+func TestServerConcurrency(t *testing.T) {
+	var pulls atomic.Int32
+	gate := make(chan struct{})
+	server := testServer(t, &pulls, gate, WithServerInsecureNoAuth(), WithServerConcurrency(1))
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 3)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = getDiff(t, server, "app:v1", "app:v2", "")
+		}()
+	}
+	require.Eventually(t, func() bool {
+		server.mtx.Lock()
+		defer server.mtx.Unlock()
+		entry, ok := server.entries[firstKey(server)]
+		return ok && entry.waiting == len(recs)
+	}, 5*time.Second, 10*time.Millisecond, "requests should share the computation")
+
+	rec := getDiff(t, server, "app:v1", "app:v3", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "requests beyond the limit should be refused")
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"), "clients should be told when to retry")
+
+	close(gate)
+	wg.Wait()
+	for _, rec := range recs {
+		assert.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	}
+	assert.Equal(t, int32(1), pulls.Load(), "diff should be computed once")
+}
+
+// firstKey returns the key of any of the server entries.
+func firstKey(s *Server) string {
+	for key := range s.entries {
+		return key
+	}
+	return ""
+}
+
+func TestServerOptions(t *testing.T) {
+	inc := New(WithTempDir(t.TempDir()))
+	_, err := NewServer(inc)
+	assert.Error(t, err, "server without tokens should be refused")
+	for _, max := range []int{0, -1} {
+		_, err = NewServer(inc, WithServerTokens("secret"), WithServerConcurrency(max))
+		assert.Error(t, err, "invalid concurrency should be refused")
+	}
+	server, err := NewServer(inc, WithServerInsecureNoAuth())
+	require.NoError(t, err, "unable to create server without authentication")
+	defer server.Close()
+	rec := getDiff(t, server, "", "", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "requests should not need tokens")
+}
+
+func TestServerAbandoned(t *testing.T) {
+	var pulls atomic.Int32
+	gate := make(chan struct{})
+	defer close(gate)
+	server := testServer(t, &pulls, gate, WithServerTokens("secret"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- getDiffContext(ctx, t, server, "app:v1", "app:v2", "secret") }()
+	require.Eventually(t, func() bool {
+		return pulls.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond, "diff should be computed")
+	cancel()
+	<-done
+	require.Eventually(t, func() bool {
+		server.mtx.Lock()
+		defer server.mtx.Unlock()
+		return len(server.entries) == 0 && len(server.slots) == 0
+	}, 5*time.Second, 10*time.Millisecond, "abandoned computation should be aborted")
+
+	server = testServer(t, &pulls, nil, WithServerTokens("secret"), WithServerTimeout(time.Nanosecond))
+	server.pull = func(ctx context.Context, base, final string) (*Diff, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	rec := getDiff(t, server, "app:v1", "app:v2", "secret")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "computations should time out")
+}
+
+func TestServerClosed(t *testing.T) {
+	var pulls atomic.Int32
+	gate := make(chan struct{})
+	server := testServer(t, &pulls, gate, WithServerTokens("secret"))
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- getDiff(t, server, "app:v1", "app:v2", "secret") }()
+	require.Eventually(t, func() bool {
+		return pulls.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond, "diff should be computed")
+	require.NoError(t, server.Close(), "unable to close server")
+	close(gate)
+	rec := <-done
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "requests in flight should be refused")
+
+	rec = getDiff(t, server, "app:v1", "app:v2", "secret")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "requests after close should be refused")
+	assert.Equal(t, int32(1), pulls.Load(), "diffs should not be computed after close")
+	_, err := os.Stat(server.dir)
+	assert.True(t, os.IsNotExist(err), "cache directory should be removed")
+}
+
+func TestServerMove(t *testing.T) {
+	var pulls atomic.Int32
+	server := testServer(t, &pulls, nil, WithServerInsecureNoAuth())
+	var pulled os.FileInfo
+	server.pull = func(ctx context.Context, base, final string) (*Diff, error) {
+		tpath := path.Join(server.inc.tmpdir, "pulled.tar")
+		require.NoError(t, os.WriteFile(tpath, []byte(base+" "+final), 0600), "unable to write archive")
+		fp, err := os.Open(tpath)
+		require.NoError(t, err, "unable to open archive")
+		pulled, err = fp.Stat()
+		require.NoError(t, err, "unable to stat archive")
+		return &Diff{ReadCloser: RemoveOnClose{fp, tpath}}, nil
+	}
+	rec := getDiff(t, server, "app:v1", "app:v2", "")
+	require.Equal(t, http.StatusOK, rec.Code, "unexpected response: %s", rec.Body)
+	assert.Equal(t, "app:v1@pinned app:v2@pinned", rec.Body.String())
+
+	cached, err := os.Stat(server.entries[firstKey(server)].path)
+	require.NoError(t, err, "diff should be cached")
+	assert.True(t, os.SameFile(pulled, cached), "pulled archive should be moved, not copied")
+}
@@ -0,0 +1,164 @@
+package imo
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// SignatureFile is the name of the file, stored in the root of the incremental
+// archive, holding the archive signature.
+const SignatureFile = "imo.sig"
+
+// SignedPayload is the content covered by the archive signature. Index is the
+// digest of the archive index.json, as the index refers to all manifests and
+// manifests refer to all blobs by digest it covers the whole oci layout. Metadata
+// is the digest of the archive metadata file.
+type SignedPayload struct {
+	Index    digest.Digest `json:"index"`
+	Metadata digest.Digest `json:"metadata"`
+}
+
+// ArchiveSignature is the content of the signature file. Payload is the encoded
+// SignedPayload and Signature is the signature over it.
+type ArchiveSignature struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// signLayout signs the index and the metadata stored in the oci layout in dir,
+// writing the signature file into the layout. The signing key is a PEM encoded
+// private key (PKCS#1, PKCS#8, EC or an encrypted sigstore/cosign key).
+func (inc *Incremental) signLayout(dir string) error {
+	priv, err := cryptoutils.UnmarshalPEMToPrivateKey(
+		inc.signingKey, cryptoutils.StaticPasswordFunc(inc.signingPass),
+	)
+	if err != nil {
+		return fmt.Errorf("error parsing signing key: %w", err)
+	}
+	signer, err := signature.LoadSigner(priv, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("error loading signing key: %w", err)
+	}
+	index, err := os.ReadFile(path.Join(dir, imgspecv1.ImageIndexFile))
+	if err != nil {
+		return fmt.Errorf("error reading index: %w", err)
+	}
+	md, err := os.ReadFile(path.Join(dir, MetadataFile))
+	if err != nil {
+		return fmt.Errorf("error reading metadata: %w", err)
+	}
+	encoded, err := json.Marshal(SignedPayload{
+		Index:    digest.FromBytes(index),
+		Metadata: digest.FromBytes(md),
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding signed payload: %w", err)
+	}
+	sig, err := signer.SignMessage(bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("error signing archive: %w", err)
+	}
+	data, err := json.Marshal(ArchiveSignature{Payload: encoded, Signature: sig})
+	if err != nil {
+		return fmt.Errorf("error encoding signature: %w", err)
+	}
+	if err := os.WriteFile(path.Join(dir, SignatureFile), data, 0o644); err != nil {
+		return fmt.Errorf("error writing signature: %w", err)
+	}
+	return nil
+}
+
+// verifySignature checks the archive signature against the provided trusted keys
+// (PEM encoded public keys). Fails if the archive is not signed, if the signature
+// has not been made by any of the trusted keys or if it does not cover the index
+// and the metadata found in the archive.
+func (a *archiveContent) verifySignature(trusted [][]byte) error {
+	if a.signature == nil {
+		return fmt.Errorf("archive is not signed")
+	}
+	var sig ArchiveSignature
+	if err := json.Unmarshal(a.signature, &sig); err != nil {
+		return fmt.Errorf("error parsing signature: %w", err)
+	}
+	if err := verifySigned(sig, trusted); err != nil {
+		return err
+	}
+	var payload SignedPayload
+	if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+		return fmt.Errorf("error parsing signed payload: %w", err)
+	}
+	if a.index == nil || payload.Index != digest.FromBytes(a.index) {
+		return fmt.Errorf("signature does not match the archive index")
+	}
+	if a.rawMetadata == nil || payload.Metadata != digest.FromBytes(a.rawMetadata) {
+		return fmt.Errorf("signature does not match the archive metadata")
+	}
+	return nil
+}
+
+// verifySigned checks that the signature has been made by one of the trusted keys.
+func verifySigned(sig ArchiveSignature, trusted [][]byte) error {
+	for _, key := range trusted {
+		pub, err := cryptoutils.UnmarshalPEMToPublicKey(key)
+		if err != nil {
+			return fmt.Errorf("error parsing trusted key: %w", err)
+		}
+		verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("error loading trusted key: %w", err)
+		}
+		err = verifier.VerifySignature(bytes.NewReader(sig.Signature), bytes.NewReader(sig.Payload))
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("archive signature not made by a trusted key")
+}
+
+// verifyArchive verifies the archive pointed by src (see Verify). If trusted keys
+// have been provided the archive signature is also verified.
+func (inc *Incremental) verifyArchive(src string) error {
+	_, err := inc.readVerified(src)
+	return err
+}
+
+// readVerified reads and verifies the archive pointed by src, as verifyArchive
+// does. Returns what has been read from the archive.
+func (inc *Incremental) readVerified(src string) (*archiveContent, error) {
+	fp, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer fp.Close()
+	content, err := readArchive(fp)
+	if err != nil {
+		return nil, err
+	}
+	if err := content.verify(); err != nil {
+		return nil, err
+	}
+	if err := inc.verifyTrusted(content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// verifyTrusted verifies the archive signature if trusted keys have been provided.
+func (inc *Incremental) verifyTrusted(content *archiveContent) error {
+	if inc.trustedKeys == nil {
+		return nil
+	}
+	if err := content.verifySignature(inc.trustedKeys); err != nil {
+		return fmt.Errorf("error verifying signature: %w", err)
+	}
+	return nil
+}
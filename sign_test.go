@@ -0,0 +1,69 @@
+package imo
+
+import (
+	"context"
+	"crypto/elliptic"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedArchive writes a signed archive holding a single image and returns the
+// layout directory and the archive path.
+func signedArchive(t *testing.T, inc *Incremental) (string, string) {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	require.NoError(t, writeMetadata(dir, Metadata{Images: []ImageMetadata{{Final: "app"}}}))
+	require.NoError(t, inc.signLayout(dir), "unable to sign layout")
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(dir, tpath), "unable to create tarball")
+	return dir, tpath
+}
+
+func TestSignature(t *testing.T) {
+	pass := []byte("secret")
+	priv, pub, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(), cryptoutils.StaticPasswordFunc(pass))
+	require.NoError(t, err, "unable to generate key pair")
+	_, other, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(), cryptoutils.StaticPasswordFunc(pass))
+	require.NoError(t, err, "unable to generate key pair")
+
+	dir, tpath := signedArchive(t, New(WithSigningKey(priv, pass)))
+	assert.NoError(t, New().verifyArchive(tpath), "signature checked without trusted keys")
+	assert.NoError(t, New(WithTrustedKeys(pub)).verifyArchive(tpath), "valid signature refused")
+	assert.NoError(t, New(WithTrustedKeys(other, pub)).verifyArchive(tpath), "valid signature refused")
+	err = New(WithTrustedKeys(other)).verifyArchive(tpath)
+	assert.ErrorContains(t, err, "not made by a trusted key")
+
+	// tampering with the metadata after signing invalidates the signature.
+	md := Metadata{Images: []ImageMetadata{{Final: "other", Omitted: []digest.Digest{digest.FromString("top")}}}}
+	require.NoError(t, writeMetadata(dir, md))
+	require.NoError(t, tarball(dir, tpath))
+	err = New(WithTrustedKeys(pub)).verifyArchive(tpath)
+	assert.ErrorContains(t, err, "does not match the archive metadata")
+
+	// archives without signature are refused.
+	require.NoError(t, os.Remove(filepath.Join(dir, SignatureFile)))
+	require.NoError(t, tarball(dir, tpath))
+	err = New(WithTrustedKeys(pub)).verifyArchive(tpath)
+	assert.ErrorContains(t, err, "archive is not signed")
+	assert.NoError(t, New().verifyArchive(tpath), "unsigned archive refused without trusted keys")
+
+	err = New(WithTrustedKeys(pub)).PushVet(context.Background(), tpath, "localhost/unused")
+	assert.ErrorContains(t, err, "archive is not signed")
+}
+
+func TestSignatureWrongPassphrase(t *testing.T) {
+	priv, _, err := cryptoutils.GeneratePEMEncodedECDSAKeyPair(elliptic.P256(), cryptoutils.StaticPasswordFunc([]byte("secret")))
+	require.NoError(t, err, "unable to generate key pair")
+	dir := t.TempDir()
+	newTestLayout(t, dir)
+	require.NoError(t, writeMetadata(dir, Metadata{}))
+	err = New(WithSigningKey(priv, []byte("wrong"))).signLayout(dir)
+	assert.Error(t, err, "key decrypted with the wrong passphrase")
+}
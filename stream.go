@@ -0,0 +1,216 @@
+package imo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/blobinfocache/none"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// PushStream pushes the incremental difference read, as an oci-archive tarball,
+// from the provided reader to the destination registry pointed by dst. Nothing is
+// written to disk: blobs are uploaded as they go by in the tar stream and only
+// manifests and configs are kept in memory. The archive is verified (see Verify and
+// WithTrustedKeys) once the stream has been fully read and before any manifest is
+// pushed, blobs already uploaded by then are left unreferenced if verification
+// fails. As with Push, layers not included in the archive must exist in the
+// destination and the image can be pushed to multiple aliases. Blobs are pushed as
+// they are stored in the archive so recompression (WithPushCompression) is not
+// supported and since the stream can't be read twice only the manifests upload is
+// retried. Archives encrypted as a whole (see WithArchiveEncryption) are decrypted
+// on the fly while archives with encrypted layers can't be streamed. Referrers are
+// re-attached as on Push.
+func (inc *Incremental) PushStream(ctx context.Context, r io.Reader, dst string, aliases ...string) (*PushResult, error) {
+	if inc.pushFormat != nil {
+		return nil, fmt.Errorf("push compression is not supported when streaming")
+	}
+	if inc.layerKeys != nil {
+		return nil, fmt.Errorf("layer decryption is not supported when streaming")
+	}
+	r, _, err := inc.decryptStream(r)
+	if err != nil {
+		return nil, err
+	}
+	dstref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", dst))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	sysctx := &types.SystemContext{
+		DockerAuthConfig:            inc.auths.PushAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePush,
+	}
+	dest, err := throttle(inc.budgeted(dstref), inc.pushLimiter).NewImageDestination(ctx, sysctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating destination: %w", err)
+	}
+	defer dest.Close()
+	content, rawman, err := inc.pushStream(ctx, r, dest)
+	if err != nil {
+		return nil, err
+	}
+	if inc.referrers && content.metadata != nil {
+		for _, img := range content.metadata.Images {
+			if err := inc.forEachReferrer(ctx, dst, img.Referrers, func(dest types.ImageDestination, referrer Referrer) error {
+				return content.putManifest(ctx, dest, referrer.Manifest, nil, map[digest.Digest]bool{})
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	result, err := newPushResult(dstref, rawman)
+	if err != nil {
+		return nil, err
+	}
+	for _, alias := range aliases {
+		if err := inc.pushAlias(ctx, result, alias); err != nil {
+			return nil, fmt.Errorf("error pushing alias %s: %w", alias, err)
+		}
+	}
+	return result, nil
+}
+
+// pushStream reads the archive from the provided reader and writes its content
+// into dest. Returns what has been read from the archive and the top level manifest.
+func (inc *Incremental) pushStream(ctx context.Context, r io.Reader, dest types.ImageDestination) (*archiveContent, []byte, error) {
+	content, err := scanArchive(r, func(content *archiveContent, r io.Reader, size int64, dgst digest.Digest) error {
+		return content.streamBlob(ctx, dest, r, size, dgst)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// encrypted streams are authenticated only once they have been fully read.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, nil, fmt.Errorf("error reading archive: %w", err)
+	}
+	if err := content.verify(); err != nil {
+		return nil, nil, fmt.Errorf("error verifying archive: %w", err)
+	}
+	if err := inc.verifyTrusted(content); err != nil {
+		return nil, nil, err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(content.index, &index); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", imgspecv1.ImageIndexFile, err)
+	}
+	if len(index.Manifests) != 1 {
+		return nil, nil, fmt.Errorf("archive must hold exactly one image, %d found", len(index.Manifests))
+	}
+	top := index.Manifests[0]
+	if err := inc.withRetry(ctx, func() error {
+		uploaded := map[digest.Digest]bool{}
+		if err := content.putManifest(ctx, dest, top, nil, uploaded); err != nil {
+			return err
+		}
+		return dest.Commit(ctx, nil)
+	}); err != nil {
+		return nil, nil, fmt.Errorf("failed pushing manifests: %w", err)
+	}
+	return content, content.small[top.Digest], nil
+}
+
+// streamBlob reads a blob of the provided size from r. Blobs that may be manifests
+// or configs are kept in memory to be uploaded once the manifests have been read,
+// all others are uploaded to dest straight away. The blob content is checked
+// against its digest.
+func (a *archiveContent) streamBlob(ctx context.Context, dest types.ImageDestination, r io.Reader, size int64, dgst digest.Digest) error {
+	buffered := bufio.NewReader(r)
+	if first, err := buffered.Peek(1); err == nil && first[0] == '{' && size <= maxManifestSize {
+		return a.readBlob(buffered, dgst)
+	}
+	verifier := dgst.Verifier()
+	info := types.BlobInfo{Digest: dgst, Size: size}
+	if _, err := dest.PutBlob(ctx, io.TeeReader(buffered, verifier), info, none.NoCache, false); err != nil {
+		return fmt.Errorf("error uploading blob %s: %w", dgst, err)
+	}
+	if _, err := io.Copy(verifier, buffered); err != nil {
+		return fmt.Errorf("error reading blob %s: %w", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s content does not match its digest", dgst)
+	}
+	a.blobs[dgst] = size
+	return nil
+}
+
+// putManifest uploads the manifest pointed by desc into dest. Everything the
+// manifest refers to is uploaded first: children for manifest lists, configs and
+// layers kept in memory for images. Layers not present in the archive must exist
+// in dest. Children of manifest lists are pushed by their digest. The uploaded
+// map records blobs already sent.
+func (a *archiveContent) putManifest(ctx context.Context, dest types.ImageDestination, desc imgspecv1.Descriptor, instance *digest.Digest, uploaded map[digest.Digest]bool) error {
+	raw := a.small[desc.Digest]
+	mime := desc.MediaType
+	if mime == "" {
+		mime = manifest.GuessMIMEType(raw)
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for _, child := range list.Instances() {
+			info, err := list.Instance(child)
+			if err != nil {
+				return fmt.Errorf("error reading instance %s: %w", child, err)
+			}
+			childdesc := imgspecv1.Descriptor{MediaType: info.MediaType, Digest: child}
+			if err := a.putManifest(ctx, dest, childdesc, &child, uploaded); err != nil {
+				return err
+			}
+		}
+	} else {
+		man, err := manifest.FromBlob(raw, mime)
+		if err != nil {
+			return fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+		}
+		if err := a.putSmallBlob(ctx, dest, man.ConfigInfo(), true, uploaded); err != nil {
+			return err
+		}
+		for _, layer := range man.LayerInfos() {
+			if err := a.putSmallBlob(ctx, dest, layer.BlobInfo, false, uploaded); err != nil {
+				return err
+			}
+		}
+	}
+	if err := dest.PutManifest(ctx, raw, instance); err != nil {
+		return fmt.Errorf("error pushing manifest %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// putSmallBlob uploads a blob kept in memory into dest. Blobs already uploaded
+// while streaming are skipped while blobs not present in the archive must exist
+// in dest.
+func (a *archiveContent) putSmallBlob(ctx context.Context, dest types.ImageDestination, info types.BlobInfo, isConfig bool, uploaded map[digest.Digest]bool) error {
+	if uploaded[info.Digest] {
+		return nil
+	}
+	if _, ok := a.blobs[info.Digest]; !ok {
+		found, _, err := dest.TryReusingBlob(ctx, info, none.NoCache, false)
+		if err != nil {
+			return fmt.Errorf("error checking blob %s in destination: %w", info.Digest, err)
+		} else if !found {
+			return fmt.Errorf("%s not found in destination", info.Digest)
+		}
+		uploaded[info.Digest] = true
+		return nil
+	}
+	data, ok := a.small[info.Digest]
+	if !ok {
+		return nil
+	}
+	if _, err := dest.PutBlob(ctx, bytes.NewReader(data), info, none.NoCache, isConfig); err != nil {
+		return fmt.Errorf("error uploading blob %s: %w", info.Digest, err)
+	}
+	uploaded[info.Digest] = true
+	return nil
+}
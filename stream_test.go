@@ -0,0 +1,81 @@
+package imo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// streamTo streams the archive pointed by src into an oci layout in dir.
+func streamTo(t *testing.T, src, dir string) ([]byte, error) {
+	ctx := context.Background()
+	dstref, err := alltransports.ParseImageName("oci:" + dir)
+	require.NoError(t, err, "unable to parse destination")
+	dest, err := dstref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err, "unable to create destination")
+	defer dest.Close()
+	fp, err := os.Open(src)
+	require.NoError(t, err, "unable to open archive")
+	defer fp.Close()
+	_, rawman, err := New().pushStream(ctx, fp, dest)
+	return rawman, err
+}
+
+func TestPushStream(t *testing.T) {
+	src := t.TempDir()
+	layout := newTestLayout(t, src)
+	desc := layout.list(t, layout.image(t, "amd64", "base", "top"), layout.image(t, "arm64", "base", "other"))
+	layout.tag(t, "", desc)
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(src, tpath), "unable to create tarball")
+
+	dst := t.TempDir()
+	rawman, err := streamTo(t, tpath, dst)
+	require.NoError(t, err, "unable to stream archive")
+	assert.Equal(t, desc.Digest, digest.FromBytes(rawman), "unexpected top level manifest")
+	dpath := filepath.Join(t.TempDir(), "pushed.tar")
+	require.NoError(t, tarball(dst, dpath), "unable to create tarball")
+	assert.NoError(t, Verify(dpath), "pushed layout does not verify")
+	for _, layer := range []string{"base", "top", "other"} {
+		dgst := digest.FromString(layer)
+		_, err := os.Stat(filepath.Join(dst, "blobs", "sha256", dgst.Encoded()))
+		assert.NoError(t, err, "layer %s not pushed", layer)
+	}
+}
+
+func TestPushStreamMissingLayer(t *testing.T) {
+	base := digest.FromString("base")
+	md := &Metadata{Images: []ImageMetadata{{Final: "app", Omitted: []digest.Digest{base}}}}
+	tpath := writeTestArchive(t, true, md)
+
+	dst := t.TempDir()
+	_, err := streamTo(t, tpath, dst)
+	require.Error(t, err, "push should fail without the omitted layer")
+	assert.Contains(t, err.Error(), "not found in destination")
+
+	// once the base layer exists in the destination the push succeeds.
+	layout := newTestLayout(t, dst)
+	layout.blob(t, "", []byte("base"))
+	_, err = streamTo(t, tpath, dst)
+	assert.NoError(t, err, "unable to stream archive")
+}
+
+func TestPushStreamCorrupted(t *testing.T) {
+	src := t.TempDir()
+	layout := newTestLayout(t, src)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	top := digest.FromString("top")
+	err := os.WriteFile(filepath.Join(src, "blobs", "sha256", top.Encoded()), []byte("tampered"), 0o644)
+	require.NoError(t, err, "unable to tamper with layer")
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	require.NoError(t, tarball(src, tpath), "unable to create tarball")
+	_, err = streamTo(t, tpath, t.TempDir())
+	assert.Error(t, err, "corrupted archive should not be pushed")
+}
@@ -0,0 +1,211 @@
+package imo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// layerIndexes is a LayerIndex made of multiple indexes, a layer is present if it
+// is present in any of them.
+type layerIndexes []LayerIndex
+
+// HasLayer returns true if any of the indexes has the layer.
+func (l layerIndexes) HasLayer(dgst digest.Digest) bool {
+	for _, index := range l {
+		if index.HasLayer(dgst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync copies the final image straight from its registry to the destination registry
+// pointed by dst, no archive is written to disk. Blobs are streamed from the source
+// to the destination and, as with a Pull followed by a Push, layers already present
+// on the other side are left out. By default the images tagged in the destination
+// repository are used to determine which layers are present, WithSyncIndexTags
+// limits the tags looked at. If bases are provided (e.g. the previous version of
+// the image) they are used instead, in which case as with Push their layers must
+// exist in the destination. The final image is pinned by digest before anything
+// is copied and referrers are copied if WithReferrers is set. Options affecting
+// only the archive (compression, encryption and signing) are not used, layers are
+// recompressed if WithPushCompression is set.
+func (inc *Incremental) Sync(ctx context.Context, final, dst string, bases ...string) (*PushResult, error) {
+	finalref, err := inc.pin(ctx, inc.finalSysctx(), final)
+	if err != nil {
+		return nil, fmt.Errorf("error pinning final reference: %w", err)
+	}
+	dstref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", dst))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing destination reference: %w", err)
+	}
+	index, pinned, err := inc.syncIndex(ctx, dstref, bases)
+	if err != nil {
+		return nil, err
+	}
+	sysctx := &types.SystemContext{
+		DockerAuthConfig:            inc.auths.PushAuth,
+		DockerInsecureSkipTLSVerify: inc.insecurePush,
+		CompressionFormat:           inc.pushFormat,
+		CompressionLevel:            inc.pushLevel,
+		BlobInfoCacheDir:            inc.blobInfoCacheDir(),
+	}
+	dest := throttle(inc.budgeted(dstref), inc.pushLimiter)
+	rawman, err := inc.syncImage(ctx, index, finalref, dest, sysctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := newPushResult(dstref, rawman)
+	if err != nil {
+		return nil, err
+	}
+	if inc.referrers {
+		if err := inc.syncReferrers(ctx, finalref, dst, pinned); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// syncIndex returns the index of the layers present in the destination. If bases
+// are provided the index holds their layers, otherwise it holds the layers of all
+// images tagged in the destination repository, or only of the tags set through
+// WithSyncIndexTags. Also returns the bases pinned by digest.
+func (inc *Incremental) syncIndex(ctx context.Context, dstref types.ImageReference, bases []string) (LayerIndex, []string, error) {
+	if len(bases) == 0 {
+		repo := reference.TrimNamed(dstref.DockerReference()).String()
+		refs := []string{repo}
+		if len(inc.syncTags) > 0 {
+			refs = []string{}
+			for _, tag := range inc.syncTags {
+				refs = append(refs, fmt.Sprintf("%s:%s", repo, tag))
+			}
+		}
+		inv := &Inventory{}
+		for _, ref := range refs {
+			found, err := inc.Inventory(ctx, ref)
+			if err != nil && !isManifestUnknown(err) {
+				return nil, nil, fmt.Errorf("error indexing destination: %w", err)
+			} else if err != nil {
+				continue
+			}
+			for _, img := range found.Images {
+				inv.Add(img)
+			}
+		}
+		return inv, nil, nil
+	}
+	sysctx := &types.SystemContext{DockerAuthConfig: inc.auths.BaseAuth}
+	indexes := layerIndexes{}
+	pinned := []string{}
+	for _, base := range bases {
+		if base == "scratch" {
+			continue
+		}
+		baseref, err := inc.pin(ctx, sysctx, base)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error pinning base reference: %w", err)
+		}
+		index := NewManifestsIndex(sysctx)
+		if err := inc.withRetry(ctx, func() error {
+			return index.FetchManifests(ctx, baseref)
+		}); err != nil {
+			return nil, nil, fmt.Errorf("error fetching manifests for %s: %w", base, err)
+		}
+		indexes = append(indexes, index)
+		pinned = append(pinned, baseref.DockerReference().String())
+	}
+	return indexes, pinned, nil
+}
+
+// syncImage copies the image pointed by srcref into dstref, accessed using the
+// provided system context, leaving out the layers present in the index. Returns
+// the manifest written to the destination.
+func (inc *Incremental) syncImage(ctx context.Context, index LayerIndex, srcref, dstref types.ImageReference, sysctx *types.SystemContext) ([]byte, error) {
+	if err := inc.validate(); err != nil {
+		return nil, err
+	}
+	polctx, err := policyContext()
+	if err != nil {
+		return nil, fmt.Errorf("error creating policy context: %w", err)
+	}
+	selection, err := inc.sourceSelection(ctx, srcref, inc.finalSysctx())
+	if err != nil {
+		return nil, err
+	}
+	var rawman []byte
+	if err := inc.withRetry(ctx, func() error {
+		destref, err := NewWriterFromIndex(ctx, index, dstref, sysctx)
+		if err != nil {
+			return fmt.Errorf("error creating incremental writer: %w", err)
+		}
+		rawman, err = copy.Image(
+			ctx,
+			polctx,
+			destref,
+			throttle(srcref, inc.pullLimiter),
+			&copy.Options{
+				ReportWriter:         inc.report,
+				SourceCtx:            inc.finalSysctx(),
+				DestinationCtx:       sysctx,
+				ImageListSelection:   selection,
+				MaxParallelDownloads: inc.parallel,
+				PreserveDigests:      inc.preserveDigests,
+			},
+		)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed copying layers: %w", err)
+	}
+	return rawman, nil
+}
+
+// syncReferrers copies the referrers of the final image, except the ones also
+// referring to any of the bases, straight to the repository pointed by dst.
+func (inc *Incremental) syncReferrers(ctx context.Context, finalref types.ImageReference, dst string, bases []string) error {
+	referrers, err := inc.newReferrers(ctx, finalref.DockerReference().String(), bases...)
+	if err != nil {
+		return err
+	}
+	if len(referrers) == 0 {
+		return nil
+	}
+	src, err := throttle(finalref, inc.pullLimiter).NewImageSource(ctx, inc.finalSysctx())
+	if err != nil {
+		return fmt.Errorf("error creating source image: %w", err)
+	}
+	defer src.Close()
+	return inc.forEachReferrer(ctx, dst, referrers, func(dest types.ImageDestination, referrer Referrer) error {
+		return putReferrer(ctx, src, dest, referrer.Manifest, nil)
+	})
+}
+
+// isRepositoryUnknown returns true if the error has been caused by a repository
+// that does not exist in the registry.
+func isRepositoryUnknown(err error) bool {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) && coder.ErrorCode() == v2.ErrorCodeNameUnknown {
+		return true
+	}
+	var codeerr errcode.Error
+	if errors.As(err, &codeerr) && codeerr.Code == errcode.ErrorCodeUnknown {
+		return strings.Contains(strings.ToLower(codeerr.Message), "not found")
+	}
+	var statuserr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statuserr) {
+		return statuserr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
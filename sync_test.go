@@ -0,0 +1,97 @@
+package imo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestSyncImage(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	layout := newTestLayout(t, src)
+	desc := layout.image(t, "amd64", "base", "top")
+	layout.tag(t, "", desc)
+	srcref, err := alltransports.ParseImageName("oci:" + src)
+	require.NoError(t, err, "unable to parse source")
+	dst := t.TempDir()
+	dstref, err := alltransports.ParseImageName("oci:" + dst)
+	require.NoError(t, err, "unable to parse destination")
+
+	base, top := digest.FromString("base"), digest.FromString("top")
+	inv := &Inventory{Images: []InventoryImage{{Repository: "app", Layers: []digest.Digest{base}}}}
+	index := layerIndexes{NewManifestsIndex(&types.SystemContext{}), inv}
+	rawman, err := New(WithPreserveDigests()).syncImage(ctx, index, srcref, dstref, &types.SystemContext{})
+	require.NoError(t, err, "unable to sync image")
+	assert.Equal(t, desc.Digest, digest.FromBytes(rawman), "manifest should be kept as is")
+
+	dgst, _ := readManifest(t, dst)
+	assert.Equal(t, desc.Digest, dgst, "image should be written to the destination")
+	_, err = os.Stat(filepath.Join(dst, "blobs", "sha256", top.Encoded()))
+	assert.NoError(t, err, "new layer should be copied")
+	_, err = os.Stat(filepath.Join(dst, "blobs", "sha256", base.Encoded()))
+	assert.True(t, os.IsNotExist(err), "layer present in the index should be left out")
+}
+
+func TestSyncIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	v1 := layout.image(t, "amd64", "base", "top")
+	v2 := layout.image(t, "amd64", "base", "other")
+	registry := newFakeRegistry(t)
+	registry.load(t, dir, "repo", "v1", v1)
+	registry.load(t, dir, "repo", "v2", v2)
+	dstref, err := alltransports.ParseImageName("docker://" + registry.host() + "/repo:v3")
+	require.NoError(t, err, "unable to parse destination")
+
+	index, pinned, err := New(WithInsecurePush()).syncIndex(ctx, dstref, nil)
+	require.NoError(t, err, "unable to index destination")
+	assert.Empty(t, pinned, "no bases should be pinned")
+	for _, layer := range []string{"base", "top", "other"} {
+		assert.True(t, index.HasLayer(digest.FromString(layer)), "layers of all destination tags should be indexed")
+	}
+
+	index, _, err = New(WithInsecurePush(), WithSyncIndexTags("v1", "missing")).syncIndex(ctx, dstref, nil)
+	require.NoError(t, err, "unable to index destination")
+	assert.True(t, index.HasLayer(digest.FromString("top")), "layers of the selected tags should be indexed")
+	assert.False(t, index.HasLayer(digest.FromString("other")), "layers of other tags should not be indexed")
+
+	dstref, err = alltransports.ParseImageName("docker://" + registry.host() + "/new:v1")
+	require.NoError(t, err, "unable to parse destination")
+	index, _, err = New(WithInsecurePush()).syncIndex(ctx, dstref, nil)
+	require.NoError(t, err, "unknown destination repository should not fail")
+	assert.False(t, index.HasLayer(digest.FromString("base")))
+}
+
+func TestIsRepositoryUnknown(t *testing.T) {
+	for _, tt := range []struct {
+		err     error
+		unknown bool
+	}{
+		{err: fmt.Errorf("listing tags: %w", v2.ErrorCodeNameUnknown.WithMessage("repository name not known")), unknown: true},
+		{err: errcode.ErrorCodeUnknown.WithMessage("Not Found"), unknown: true},
+		{err: docker.UnexpectedHTTPStatusError{StatusCode: 404}, unknown: true},
+		{err: docker.UnexpectedHTTPStatusError{StatusCode: 500}, unknown: false},
+		{err: errcode.ErrorCodeUnauthorized.WithMessage("authentication required"), unknown: false},
+		{err: errors.New("connection refused"), unknown: false},
+	} {
+		assert.Equal(t, tt.unknown, isRepositoryUnknown(tt.err), "unexpected result for %v", tt.err)
+		assert.Equal(t, tt.unknown, isManifestUnknown(tt.err), "unexpected result for %v", tt.err)
+	}
+	err := fmt.Errorf("reading manifest: %w", v2.ErrorCodeManifestUnknown.WithMessage("manifest unknown"))
+	assert.True(t, isManifestUnknown(err), "unknown manifests should be detected")
+	assert.False(t, isRepositoryUnknown(err), "unknown manifests are not unknown repositories")
+}
@@ -0,0 +1,269 @@
+package imo
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/manifest"
+)
+
+// maxManifestSize is the maximum size of a blob we consider as a possible manifest.
+// Blobs with content starting with '{' and smaller than this are kept in memory
+// while reading an archive.
+const maxManifestSize = 4 * 1024 * 1024
+
+// archiveContent holds what has been found while reading an incremental archive.
+// Sizes of all blobs are kept in blobs while the content of blobs that may be
+// manifests (or configs) is kept in small. The metadata is kept both parsed and
+// raw as the archive signature covers the raw content.
+type archiveContent struct {
+	blobs       map[digest.Digest]int64
+	small       map[digest.Digest][]byte
+	index       []byte
+	layout      []byte
+	metadata    *Metadata
+	rawMetadata []byte
+	signature   []byte
+}
+
+// Verify checks the integrity of the incremental archive pointed by src. Every blob
+// in the archive is checked against its digest, the index and all manifests must
+// parse, the sizes recorded in the manifests must match the blobs and every layer
+// must either be present in the archive or be recorded as omitted in the archive
+// metadata. Archives without metadata can't tell omitted layers apart from missing
+// ones, for those archives absent layers are not reported. Referrers recorded in the
+// metadata must be present in the archive, as images their layers may be omitted.
+func Verify(src string) error {
+	fp, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening archive: %w", err)
+	}
+	defer fp.Close()
+	content, err := readArchive(fp)
+	if err != nil {
+		return err
+	}
+	return content.verify()
+}
+
+// readArchive reads an archive from the provided reader. All blobs are checked
+// against their digests.
+func readArchive(r io.Reader) (*archiveContent, error) {
+	return scanArchive(r, func(content *archiveContent, r io.Reader, _ int64, dgst digest.Digest) error {
+		return content.readBlob(r, dgst)
+	})
+}
+
+// scanArchive reads an archive from the provided reader. The index, the layout
+// and the metadata are stored in the returned content while blobs are handed
+// over, with their size, to the provided function.
+func scanArchive(r io.Reader, blobfn func(*archiveContent, io.Reader, int64, digest.Digest) error) (*archiveContent, error) {
+	content := &archiveContent{
+		blobs: map[digest.Digest]int64{},
+		small: map[digest.Digest][]byte{},
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return content, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		switch name {
+		case imgspecv1.ImageIndexFile:
+			if content.index, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("error reading index: %w", err)
+			}
+		case imgspecv1.ImageLayoutFile:
+			if content.layout, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("error reading layout: %w", err)
+			}
+		case MetadataFile:
+			if content.rawMetadata, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("error reading metadata: %w", err)
+			}
+			var md Metadata
+			if err := json.Unmarshal(content.rawMetadata, &md); err != nil {
+				return nil, fmt.Errorf("error decoding metadata: %w", err)
+			}
+			content.metadata = &md
+		case SignatureFile:
+			if content.signature, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("error reading signature: %w", err)
+			}
+		default:
+			dgst, err := blobDigest(name)
+			if err != nil {
+				return nil, err
+			} else if dgst == "" {
+				continue
+			}
+			if err := blobfn(content, tr, hdr.Size, dgst); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// blobDigest returns the digest of the blob stored at the provided path inside an
+// oci layout. Returns an empty digest if the path does not point to a blob.
+func blobDigest(name string) (digest.Digest, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != imgspecv1.ImageBlobsDir {
+		return "", nil
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("invalid blob %s: %w", name, err)
+	}
+	return dgst, nil
+}
+
+// readBlob reads a blob from the provided reader, making sure its content matches
+// the digest. Blobs that may be manifests are kept in memory.
+func (a *archiveContent) readBlob(r io.Reader, dgst digest.Digest) error {
+	verifier := dgst.Verifier()
+	buffered := bufio.NewReader(io.TeeReader(r, verifier))
+	var data []byte
+	if first, err := buffered.Peek(1); err == nil && first[0] == '{' {
+		if data, err = io.ReadAll(io.LimitReader(buffered, maxManifestSize+1)); err != nil {
+			return fmt.Errorf("error reading blob %s: %w", dgst, err)
+		}
+	}
+	size, err := io.Copy(io.Discard, buffered)
+	if err != nil {
+		return fmt.Errorf("error reading blob %s: %w", dgst, err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s content does not match its digest", dgst)
+	}
+	a.blobs[dgst] = size + int64(len(data))
+	if data != nil && len(data) <= maxManifestSize {
+		a.small[dgst] = data
+	}
+	return nil
+}
+
+// verify checks the archive structure. See Verify for details.
+func (a *archiveContent) verify() error {
+	if a.layout == nil {
+		return fmt.Errorf("archive has no %s", imgspecv1.ImageLayoutFile)
+	}
+	var layout imgspecv1.ImageLayout
+	if err := json.Unmarshal(a.layout, &layout); err != nil {
+		return fmt.Errorf("error parsing %s: %w", imgspecv1.ImageLayoutFile, err)
+	}
+	if a.index == nil {
+		return fmt.Errorf("archive has no %s", imgspecv1.ImageIndexFile)
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(a.index, &index); err != nil {
+		return fmt.Errorf("error parsing %s: %w", imgspecv1.ImageIndexFile, err)
+	}
+	var omitted map[digest.Digest]bool
+	if a.metadata != nil {
+		omitted = map[digest.Digest]bool{}
+		for _, img := range a.metadata.Images {
+			for _, dgst := range img.Omitted {
+				omitted[dgst] = true
+			}
+		}
+	}
+	for _, desc := range index.Manifests {
+		if err := a.verifyManifest(desc, omitted); err != nil {
+			return err
+		}
+	}
+	if a.metadata == nil {
+		return nil
+	}
+	for _, img := range a.metadata.Images {
+		for _, referrer := range img.Referrers {
+			if err := a.verifyManifest(referrer.Manifest, omitted); err != nil {
+				return fmt.Errorf("referrer %s: %w", referrer.Manifest.Digest, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyManifest verifies the manifest (or manifest list) pointed by the descriptor
+// and everything it refers to. Layers are allowed to be absent if they are in the
+// omitted map or if the omitted map is nil.
+func (a *archiveContent) verifyManifest(desc imgspecv1.Descriptor, omitted map[digest.Digest]bool) error {
+	if err := a.verifyBlob(desc.Digest, desc.Size); err != nil {
+		return fmt.Errorf("manifest %w", err)
+	}
+	raw, ok := a.small[desc.Digest]
+	if !ok {
+		return fmt.Errorf("manifest %s is not a valid manifest", desc.Digest)
+	}
+	mime := desc.MediaType
+	if mime == "" {
+		mime = manifest.GuessMIMEType(raw)
+	}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		list, err := manifest.ListFromBlob(raw, mime)
+		if err != nil {
+			return fmt.Errorf("error parsing manifest list %s: %w", desc.Digest, err)
+		}
+		for _, instance := range list.Instances() {
+			info, err := list.Instance(instance)
+			if err != nil {
+				return fmt.Errorf("error reading instance %s: %w", instance, err)
+			}
+			child := imgspecv1.Descriptor{
+				MediaType: info.MediaType,
+				Digest:    info.Digest,
+				Size:      info.Size,
+			}
+			if err := a.verifyManifest(child, omitted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest %s: %w", desc.Digest, err)
+	}
+	config := man.ConfigInfo()
+	if err := a.verifyBlob(config.Digest, config.Size); err != nil {
+		return fmt.Errorf("config %w", err)
+	}
+	for _, layer := range man.LayerInfos() {
+		if _, ok := a.blobs[layer.Digest]; !ok && (omitted == nil || omitted[layer.Digest]) {
+			continue
+		}
+		if err := a.verifyBlob(layer.Digest, layer.Size); err != nil {
+			return fmt.Errorf("layer %w", err)
+		}
+	}
+	return nil
+}
+
+// verifyBlob checks that the blob is present in the archive and that it has the
+// expected size. Sizes lower than zero are not checked.
+func (a *archiveContent) verifyBlob(dgst digest.Digest, size int64) error {
+	actual, ok := a.blobs[dgst]
+	if !ok {
+		return fmt.Errorf("%s not found in archive", dgst)
+	}
+	if size >= 0 && size != actual {
+		return fmt.Errorf("%s size mismatch, expected %d, found %d", dgst, size, actual)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package imo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestArchive writes a layout with a single image, made of a base and a top
+// layer, removes the base layer if omit is true and returns the archive path.
+func writeTestArchive(t *testing.T, omit bool, md *Metadata) string {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	if omit {
+		base := digest.FromString("base")
+		err := os.Remove(filepath.Join(dir, "blobs", "sha256", base.Encoded()))
+		require.NoError(t, err, "unable to remove base layer")
+	}
+	if md != nil {
+		err := writeMetadata(dir, *md)
+		require.NoError(t, err, "unable to write metadata")
+	}
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err := tarball(dir, tpath)
+	require.NoError(t, err, "unable to create tarball")
+	return tpath
+}
+
+func TestVerify(t *testing.T) {
+	base := digest.FromString("base")
+	omitted := &Metadata{Images: []ImageMetadata{{Final: "app", Omitted: []digest.Digest{base}}}}
+	for _, tt := range []struct {
+		name    string
+		omit    bool
+		md      *Metadata
+		success bool
+	}{
+		{
+			name:    "complete archive",
+			md:      &Metadata{Images: []ImageMetadata{{Final: "app"}}},
+			success: true,
+		},
+		{
+			name:    "layer recorded as omitted",
+			omit:    true,
+			md:      omitted,
+			success: true,
+		},
+		{
+			name: "layer missing",
+			omit: true,
+			md:   &Metadata{Images: []ImageMetadata{{Final: "app"}}},
+		},
+		{
+			name:    "archive without metadata",
+			omit:    true,
+			success: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(writeTestArchive(t, tt.omit, tt.md))
+			assert.Equal(t, tt.success, err == nil, "unexpected result: %v", err)
+		})
+	}
+}
+
+func TestVerifyCorruptedBlob(t *testing.T) {
+	dir := t.TempDir()
+	layout := newTestLayout(t, dir)
+	layout.tag(t, "", layout.image(t, "amd64", "base", "top"))
+	top := digest.FromString("top")
+	err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", top.Encoded()), []byte("tampered"), 0o644)
+	require.NoError(t, err, "unable to tamper with layer")
+	tpath := filepath.Join(t.TempDir(), "archive.tar")
+	err = tarball(dir, tpath)
+	require.NoError(t, err, "unable to create tarball")
+	err = Verify(tpath)
+	require.Error(t, err, "corrupted archive should not verify")
+	assert.Contains(t, err.Error(), "does not match its digest")
+}
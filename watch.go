@@ -0,0 +1,362 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+)
+
+// WatchStateFile is the file, inside the outbox, where the Watcher records the
+// digest each watched tag pointed to when it was last checked.
+const WatchStateFile = ".imo-watch.json"
+
+// WatcherOption is a functional option for the Watcher type.
+type WatcherOption func(*Watcher)
+
+// WithWatchInterval sets how often Run checks the watched references. By default
+// they are checked every five minutes.
+func WithWatchInterval(interval time.Duration) WatcherOption {
+	return func(w *Watcher) {
+		w.interval = interval
+	}
+}
+
+// WithWatchTokens sets the bearer tokens webhooks must carry. Webhooks without one
+// of the tokens in their Authorization header are refused. Without tokens all
+// webhooks are refused unless WithWatchInsecureNoAuth is used.
+func WithWatchTokens(tokens ...string) WatcherOption {
+	return func(w *Watcher) {
+		for _, token := range tokens {
+			w.tokens = append(w.tokens, []byte(token))
+		}
+	}
+}
+
+// WithWatchInsecureNoAuth makes the Watcher accept webhooks without tokens. Anyone
+// reaching the Watcher can then make it query the registries, this should only be
+// used when access to the Watcher is restricted by other means.
+func WithWatchInsecureNoAuth() WatcherOption {
+	return func(w *Watcher) {
+		w.noauth = true
+	}
+}
+
+// WatchEvent describes an archive produced by the Watcher because Reference moved
+// from one digest to another. Archive is the name of the archive in the outbox and
+// Metadata the metadata stored in it. From is empty when the archive holds the
+// whole image, as happens when the previous digest is no longer in the registry.
+// Events are written to the outbox, next to the archive, as JSON files named after
+// it.
+type WatchEvent struct {
+	Reference string        `json:"reference"`
+	From      digest.Digest `json:"from,omitempty"`
+	To        digest.Digest `json:"to"`
+	Archive   string        `json:"archive"`
+	Created   time.Time     `json:"created"`
+	Metadata  Metadata      `json:"metadata"`
+}
+
+// Watcher watches a list of tags, and repositories, and produces an incremental
+// archive whenever a tag moves to a different digest. Archives go from the previous
+// digest to the new one and are written, along with a JSON file describing them
+// (see WatchEvent), into an outbox directory. The JSON file is written once the
+// archive is complete so consumers can rely on it to pick the archives up. The
+// digests seen are recorded in the outbox (see WatchStateFile) so the Watcher can
+// be restarted without missing or repeating archives. Tags seen for the first time
+// are only recorded. If the previous digest is no longer in the registry (e.g. it
+// has been garbage collected) the archive holds the whole new image. Archives are
+// produced using Pull so all options set in the Incremental apply, as both digests
+// live in the same repository the base and the final authentications should be the
+// same. Watcher is also an http.Handler receiving registry webhooks, see ServeHTTP.
+type Watcher struct {
+	inc      *Incremental
+	refs     []reference.Named
+	outbox   string
+	interval time.Duration
+	tokens   [][]byte
+	noauth   bool
+	trigger  chan struct{}
+	mtx      sync.Mutex
+	seen     map[string]digest.Digest
+	resolve  func(ctx context.Context, ref reference.Named) (digest.Digest, error)
+	tags     func(ctx context.Context, repo reference.Named) ([]string, error)
+	pull     func(ctx context.Context, base, final string) (*Diff, error)
+}
+
+// NewWatcher returns a Watcher for the provided references, writing the archives
+// into the outbox directory. References without a tag (repositories) have all
+// their tags watched, tags created later included. The outbox is created if
+// needed and the digests recorded in it by previous runs are loaded.
+func NewWatcher(inc *Incremental, outbox string, refs []string, opts ...WatcherOption) (*Watcher, error) {
+	w := &Watcher{
+		inc:      inc,
+		outbox:   outbox,
+		interval: 5 * time.Minute,
+		trigger:  make(chan struct{}, 1),
+		seen:     map[string]digest.Digest{},
+		resolve:  inc.resolveDigest,
+		tags:     inc.repositoryTags,
+		pull:     inc.Pull,
+	}
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing reference %s: %w", ref, err)
+		}
+		if _, ok := named.(reference.Digested); ok {
+			return nil, fmt.Errorf("reference %s is pinned by digest and can't move", ref)
+		}
+		w.refs = append(w.refs, named)
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if err := os.MkdirAll(outbox, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating outbox: %w", err)
+	}
+	data, err := os.ReadFile(path.Join(outbox, WatchStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading watch state: %w", err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &w.seen); err != nil {
+			return nil, fmt.Errorf("error decoding watch state: %w", err)
+		}
+	}
+	return w, nil
+}
+
+// Run checks the watched references every interval, and whenever a webhook is
+// received, until the context is done. Errors are reported to the report writer
+// and do not stop the Watcher, references failing to be checked are checked again
+// on the next round. Returns the context error.
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.Check(ctx); err != nil {
+			fmt.Fprintf(w.inc.report, "error checking watched images: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-w.trigger:
+		}
+	}
+}
+
+// Check checks all the watched references once, producing an archive for each tag
+// that moved since the last check. Returns the events for the produced archives
+// and the errors found, a reference failing does not prevent the others from
+// being checked.
+func (w *Watcher) Check(ctx context.Context) ([]WatchEvent, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	tagged, errs := w.expand(ctx)
+	events := []WatchEvent{}
+	for _, ref := range tagged {
+		event, err := w.check(ctx, ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error checking %s: %w", ref, err))
+			continue
+		}
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+	return events, errors.Join(errs...)
+}
+
+// ServeHTTP receives registry webhooks (e.g. push notifications) and triggers a
+// check of the watched references on Run. Registries differ in the format of their
+// notifications so the payload is not inspected, any authorized POST request
+// triggers a check of all references. See WithWatchTokens.
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !w.noauth && !bearerAuthorized(r, w.tokens) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="imo"`)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// expand returns the tagged references to check, repositories are expanded to
+// their tags. Tags used to attach artifacts (e.g. sha256-<digest>.sig) are not
+// watched.
+func (w *Watcher) expand(ctx context.Context) ([]reference.NamedTagged, []error) {
+	tagged := []reference.NamedTagged{}
+	errs := []error{}
+	for _, named := range w.refs {
+		if !reference.IsNameOnly(named) {
+			tagged = append(tagged, named.(reference.NamedTagged))
+			continue
+		}
+		tags, err := w.tags(ctx, named)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error listing tags for %s: %w", named, err))
+			continue
+		}
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, digest.Canonical.String()+"-") {
+				continue
+			}
+			ref, err := reference.WithTag(named, tag)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error tagging %s with %s: %w", named, tag, err))
+				continue
+			}
+			tagged = append(tagged, ref)
+		}
+	}
+	return tagged, errs
+}
+
+// check resolves the reference and, if it moved since the last check, produces
+// an archive from the previous digest to the current one. The new digest is only
+// recorded once the archive has been produced. Returns nil if the reference did
+// not move.
+func (w *Watcher) check(ctx context.Context, ref reference.NamedTagged) (*WatchEvent, error) {
+	dgst, err := w.resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	previous, ok := w.seen[ref.String()]
+	if ok && previous == dgst {
+		return nil, nil
+	}
+	var event *WatchEvent
+	if !ok {
+		fmt.Fprintf(w.inc.report, "watching %s at %s\n", ref, dgst)
+	} else {
+		fmt.Fprintf(w.inc.report, "%s moved from %s to %s\n", ref, previous, dgst)
+		if event, err = w.produce(ctx, ref, previous, dgst); err != nil {
+			return nil, err
+		}
+	}
+	w.seen[ref.String()] = dgst
+	if err := w.save(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// produce pulls the archive going from one digest of the reference to the other
+// into the outbox and writes the event describing it.
+func (w *Watcher) produce(ctx context.Context, ref reference.NamedTagged, from, to digest.Digest) (*WatchEvent, error) {
+	repo := reference.TrimNamed(ref)
+	final := fmt.Sprintf("%s@%s", repo, to)
+	diff, err := w.pull(ctx, fmt.Sprintf("%s@%s", repo, from), final)
+	if err != nil && isManifestUnknown(err) {
+		fmt.Fprintf(w.inc.report, "previous digest %s of %s no longer available, archiving the whole image: %v\n", from, ref, err)
+		from = ""
+		diff, err = w.pull(ctx, "scratch", final)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error pulling diff: %w", err)
+	}
+	defer diff.Close()
+	sanitize := strings.NewReplacer("/", "_", ":", "_")
+	origin := "scratch"
+	if from != "" {
+		origin = fmt.Sprintf("%.12s", from.Encoded())
+	}
+	name := fmt.Sprintf("%s_%s-%s-%.12s", sanitize.Replace(repo.String()), ref.Tag(), origin, to.Encoded())
+	if err := w.write(name+".tar", func(fp io.Writer) error {
+		_, err := io.Copy(fp, diff)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("error writing archive: %w", err)
+	}
+	event := &WatchEvent{
+		Reference: ref.String(),
+		From:      from,
+		To:        to,
+		Archive:   name + ".tar",
+		Created:   time.Now(),
+		Metadata:  diff.Metadata,
+	}
+	if err := w.write(name+".json", func(fp io.Writer) error {
+		encoder := json.NewEncoder(fp)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(event)
+	}); err != nil {
+		return nil, fmt.Errorf("error writing event: %w", err)
+	}
+	return event, nil
+}
+
+// save records the digests seen into the outbox.
+func (w *Watcher) save() error {
+	if err := w.write(WatchStateFile, func(fp io.Writer) error {
+		return json.NewEncoder(fp).Encode(w.seen)
+	}); err != nil {
+		return fmt.Errorf("error writing watch state: %w", err)
+	}
+	return nil
+}
+
+// write writes, using fn, the file with the provided name into the outbox. The
+// content is written to a hidden temporary file first and then moved in place so
+// consumers never see partially written files.
+func (w *Watcher) write(name string, fn func(io.Writer) error) error {
+	tmp := path.Join(w.outbox, fmt.Sprintf(".%s.tmp", name))
+	defer os.Remove(tmp)
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fn(fp); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(w.outbox, name))
+}
+
+// resolveDigest returns the digest the reference points to in the registry. The
+// registry is always asked, tag resolutions kept in the cache may be stale.
+func (inc *Incremental) resolveDigest(ctx context.Context, ref reference.Named) (digest.Digest, error) {
+	return inc.tagDigest(ctx, inc.finalSysctx(), reference.TagNameOnly(ref))
+}
+
+// repositoryTags returns the tags of the repository, accessed as the final image.
+func (inc *Incremental) repositoryTags(ctx context.Context, repo reference.Named) ([]string, error) {
+	ref, err := docker.NewReference(reference.TagNameOnly(repo))
+	if err != nil {
+		return nil, fmt.Errorf("error creating reference for %s: %w", repo, err)
+	}
+	var tags []string
+	if err := inc.withRetry(ctx, func() error {
+		if err := inc.spend(ctx, reference.Domain(repo)); err != nil {
+			return err
+		}
+		tags, err = docker.GetRepositoryTags(ctx, inc.finalSysctx(), ref)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -0,0 +1,208 @@
+package imo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker/reference"
+)
+
+// testRegistry is a fake registry for the Watcher, holding the digest each tag
+// points to. Pulls fail while failing is set, pulls from a deleted digest fail as
+// the manifest is unknown.
+type testRegistry struct {
+	mtx     sync.Mutex
+	digests map[string]digest.Digest
+	deleted map[digest.Digest]bool
+	failing bool
+}
+
+// move points the tag to a new digest computed from content.
+func (r *testRegistry) move(ref, content string) digest.Digest {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.digests[ref] = digest.FromString(content)
+	return r.digests[ref]
+}
+
+// testWatcher returns a Watcher, writing into outbox, whose registry operations
+// are served by the provided fake registry.
+func testWatcher(t *testing.T, registry *testRegistry, outbox string, refs []string, opts ...WatcherOption) *Watcher {
+	watcher, err := NewWatcher(New(), outbox, refs, opts...)
+	require.NoError(t, err, "unable to create watcher")
+	watcher.resolve = func(ctx context.Context, ref reference.Named) (digest.Digest, error) {
+		registry.mtx.Lock()
+		defer registry.mtx.Unlock()
+		dgst, ok := registry.digests[ref.String()]
+		if !ok {
+			return "", errors.New("manifest unknown")
+		}
+		return dgst, nil
+	}
+	watcher.tags = func(ctx context.Context, repo reference.Named) ([]string, error) {
+		registry.mtx.Lock()
+		defer registry.mtx.Unlock()
+		tags := []string{}
+		for ref := range registry.digests {
+			if tag, ok := strings.CutPrefix(ref, repo.String()+":"); ok {
+				tags = append(tags, tag)
+			}
+		}
+		return tags, nil
+	}
+	watcher.pull = func(ctx context.Context, base, final string) (*Diff, error) {
+		registry.mtx.Lock()
+		defer registry.mtx.Unlock()
+		if registry.failing {
+			return nil, errors.New("registry unavailable")
+		}
+		if _, from, ok := strings.Cut(base, "@"); ok && registry.deleted[digest.Digest(from)] {
+			return nil, fmt.Errorf("error pinning base reference: %w", v2.ErrorCodeManifestUnknown.WithMessage("manifest unknown"))
+		}
+		md := Metadata{Images: []ImageMetadata{{Base: base, Final: final}}}
+		return &Diff{ReadCloser: io.NopCloser(strings.NewReader(base + " " + final)), Metadata: md}, nil
+	}
+	return watcher
+}
+
+func TestWatcherCheck(t *testing.T) {
+	ctx := context.Background()
+	outbox := t.TempDir()
+	registry := &testRegistry{digests: map[string]digest.Digest{}}
+	v1 := registry.move("quay.io/org/app:v1", "app-v1")
+	registry.move("quay.io/org/tools:latest", "tools-1")
+	registry.move("quay.io/org/tools:sha256-abc.sig", "signature")
+	refs := []string{"quay.io/org/app:v1", "quay.io/org/tools"}
+	watcher := testWatcher(t, registry, outbox, refs)
+
+	events, err := watcher.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+	assert.Empty(t, events, "references seen for the first time should only be recorded")
+	assert.Len(t, watcher.seen, 2, "artifact tags should not be watched")
+	events, err = watcher.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+	assert.Empty(t, events, "references not moved should not produce archives")
+
+	v2 := registry.move("quay.io/org/app:v1", "app-v2")
+	events, err = watcher.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+	require.Len(t, events, 1, "moved reference should produce an archive")
+	event := events[0]
+	assert.Equal(t, "quay.io/org/app:v1", event.Reference)
+	assert.Equal(t, v1, event.From)
+	assert.Equal(t, v2, event.To)
+	data, err := os.ReadFile(filepath.Join(outbox, event.Archive))
+	require.NoError(t, err, "unable to read archive")
+	assert.Equal(t, "quay.io/org/app@"+v1.String()+" quay.io/org/app@"+v2.String(), string(data))
+	data, err = os.ReadFile(filepath.Join(outbox, strings.TrimSuffix(event.Archive, ".tar")+".json"))
+	require.NoError(t, err, "unable to read event")
+	var written WatchEvent
+	require.NoError(t, json.Unmarshal(data, &written), "unable to decode event")
+	assert.Equal(t, event.Archive, written.Archive)
+	assert.Equal(t, "quay.io/org/app@"+v2.String(), written.Metadata.Images[0].Final)
+
+	registry.move("quay.io/org/tools:latest", "tools-2")
+	registry.failing = true
+	events, err = watcher.Check(ctx)
+	assert.Error(t, err, "failed pulls should be returned")
+	assert.Empty(t, events)
+	registry.failing = false
+
+	restarted := testWatcher(t, registry, outbox, refs)
+	events, err = restarted.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+	require.Len(t, events, 1, "failed archive should be produced once the registry recovers")
+	assert.Equal(t, "quay.io/org/tools:latest", events[0].Reference)
+	entries, err := os.ReadDir(outbox)
+	require.NoError(t, err, "unable to read outbox")
+	assert.Len(t, entries, 5, "outbox should hold two archives, their events and the state")
+
+	_, err = NewWatcher(New(), outbox, []string{"quay.io/org/app@" + v1.String()})
+	assert.Error(t, err, "references pinned by digest can't be watched")
+}
+
+func TestWatcherMissingBase(t *testing.T) {
+	ctx := context.Background()
+	outbox := t.TempDir()
+	registry := &testRegistry{digests: map[string]digest.Digest{}, deleted: map[digest.Digest]bool{}}
+	v1 := registry.move("quay.io/org/app:v1", "app-v1")
+	watcher := testWatcher(t, registry, outbox, []string{"quay.io/org/app:v1"})
+	_, err := watcher.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+
+	v2 := registry.move("quay.io/org/app:v1", "app-v2")
+	registry.deleted[v1] = true
+	events, err := watcher.Check(ctx)
+	require.NoError(t, err, "missing previous digest should not fail the check")
+	require.Len(t, events, 1, "moved reference should produce an archive")
+	assert.Empty(t, events[0].From, "archive should hold the whole image")
+	assert.Equal(t, v2, events[0].To)
+	assert.Contains(t, events[0].Archive, "-scratch-", "archive name should tell it holds the whole image")
+	data, err := os.ReadFile(filepath.Join(outbox, events[0].Archive))
+	require.NoError(t, err, "unable to read archive")
+	assert.Equal(t, "scratch quay.io/org/app@"+v2.String(), string(data))
+	assert.Equal(t, v2, watcher.seen["quay.io/org/app:v1"], "new digest should be recorded")
+
+	events, err = watcher.Check(ctx)
+	require.NoError(t, err, "unable to check references")
+	assert.Empty(t, events, "reference should not be stuck")
+}
+
+func TestWatcherWebhook(t *testing.T) {
+	outbox := t.TempDir()
+	registry := &testRegistry{digests: map[string]digest.Digest{}}
+	registry.move("quay.io/org/app:v1", "app-v1")
+	watcher := testWatcher(t, registry, outbox, []string{"quay.io/org/app:v1"}, WithWatchInterval(time.Hour), WithWatchTokens("secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watcher.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(outbox, WatchStateFile))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "first check should record the reference")
+
+	registry.move("quay.io/org/app:v1", "app-v2")
+	rec := httptest.NewRecorder()
+	watcher.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "webhooks without token should be refused")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	watcher.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, "only POST should be accepted")
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"events":[]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	watcher.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code, "webhook should be accepted")
+
+	require.Eventually(t, func() bool {
+		matches, err := filepath.Glob(filepath.Join(outbox, "quay.io_*.json"))
+		return err == nil && len(matches) == 1
+	}, 5*time.Second, 10*time.Millisecond, "webhook should trigger a check")
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	rec = httptest.NewRecorder()
+	testWatcher(t, registry, outbox, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "webhooks should be refused without tokens")
+	rec = httptest.NewRecorder()
+	testWatcher(t, registry, outbox, nil, WithWatchInsecureNoAuth()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code, "webhooks should be accepted when authentication is disabled")
+}
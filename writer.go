@@ -3,10 +3,19 @@ package imo
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 
+	"github.com/opencontainers/go-digest"
 	"go.podman.io/image/v5/types"
 )
 
+// LayerIndex is implemented by entities capable of telling if a layer is already
+// present on the other side. Layers present in a LayerIndex are not copied.
+type LayerIndex interface {
+	HasLayer(dgst digest.Digest) bool
+}
+
 // Writer provides a tool to copy only the layers that are not already
 // present in a different version of the same image.
 type Writer struct {
@@ -14,6 +23,19 @@ type Writer struct {
 	dest *destwrap
 }
 
+// Omitted returns the digests of the layers that have not been written because
+// they are already present on the other side.
+func (i *Writer) Omitted() []digest.Digest {
+	i.dest.mtx.Lock()
+	defer i.dest.mtx.Unlock()
+	omitted := []digest.Digest{}
+	for dgst := range i.dest.omitted {
+		omitted = append(omitted, dgst)
+	}
+	slices.Sort(omitted)
+	return omitted
+}
+
 // NewImageDestination returns a handler used to write.
 func (i *Writer) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
 	return i.dest, nil
@@ -24,18 +46,25 @@ func (i *Writer) NewImageDestination(ctx context.Context, sys *types.SystemConte
 // layers that are already present.
 type destwrap struct {
 	types.ImageDestination
-	baseimage *ManifestsIndex
+	baseimage LayerIndex
+	mtx       sync.Mutex
+	omitted   map[digest.Digest]bool
 }
 
 // TryReusingBlob is called by the image copy code to check if a layer is
 // already present in the destination. If it is, we return true and the
 // layer info. If it is not, we return false and the layer info. We use the
-// manifest to check if the layer is already present.
+// manifest to check if the layer is already present. Blobs already written
+// to the destination (e.g. shared by multiple images in a bundle) are also
+// reused.
 func (d *destwrap) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, substitute bool) (bool, types.BlobInfo, error) {
 	if d.baseimage.HasLayer(info.Digest) {
+		d.mtx.Lock()
+		d.omitted[info.Digest] = true
+		d.mtx.Unlock()
 		return true, info, nil
 	}
-	return false, info, nil
+	return d.ImageDestination.TryReusingBlob(ctx, info, cache, substitute)
 }
 
 // NewWriterFromScratch uses the "scratch" image as base and stores the
@@ -50,6 +79,7 @@ func NewWriterFromScratch(ctx context.Context, to types.ImageReference, sysctx *
 		dest: &destwrap{
 			ImageDestination: toref,
 			baseimage:        NewManifestsIndex(sysctx),
+			omitted:          map[digest.Digest]bool{},
 		},
 	}, nil
 }
@@ -70,6 +100,25 @@ func NewWriter(ctx context.Context, from types.ImageReference, to types.ImageRef
 		dest: &destwrap{
 			ImageDestination: toref,
 			baseimage:        baseimage,
+			omitted:          map[digest.Digest]bool{},
+		},
+	}, nil
+}
+
+// NewWriterFromIndex is capable of providing an incremental copy of an image
+// skipping all the layers present in the provided index and storing the result
+// in 'to'.
+func NewWriterFromIndex(ctx context.Context, index LayerIndex, to types.ImageReference, sysctx *types.SystemContext) (*Writer, error) {
+	toref, err := to.NewImageDestination(ctx, sysctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating destination: %w", err)
+	}
+	return &Writer{
+		ImageReference: to,
+		dest: &destwrap{
+			ImageDestination: toref,
+			baseimage:        index,
+			omitted:          map[digest.Digest]bool{},
 		},
 	}, nil
 }